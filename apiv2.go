@@ -1,54 +1,298 @@
+// +build ignore
+
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
-	//"flag"
 	"fmt"
-	//"io"
-	//"io/ioutil"
-	"log"
-	//"os"
-	//"path/filepath"
 
 	dialogflow "cloud.google.com/go/dialogflow/apiv2"
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
 	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc"
 )
 
+//GrpcNLU talks to Dialogflow through the official apiv2 SessionsClient
+type GrpcNLU struct {
+	ProjectID   string
+	client      *dialogflow.SessionsClient
+	entityTypes *dialogflow.SessionEntityTypesClient
+}
 
-func DetectIntentText(projectID, sessionID, text, languageCode string) (string, error) {
-	ctx := context.Background()
-
-	sessionClient, err := dialogflow.NewSessionsClient(ctx)
+func NewGrpcNLU(ctx context.Context, projectID, endpoint string, insecure bool, creds oauth2.TokenSource) (*GrpcNLU, error) {
+	sessionClient, err := dialogflow.NewSessionsClient(ctx, clientOptions(endpoint, insecure, creds)...)
+	if err != nil {
+		return nil, err
+	}
+	entityTypesClient, err := dialogflow.NewSessionEntityTypesClient(ctx, clientOptions(endpoint, insecure, creds)...)
 	if err != nil {
-		return "", err
+		sessionClient.Close()
+		return nil, err
 	}
-	defer sessionClient.Close()
+	return &GrpcNLU{ProjectID: projectID, client: sessionClient, entityTypes: entityTypesClient}, nil
+}
+
+func (n *GrpcNLU) Close() error {
+	n.entityTypes.Close()
+	return n.client.Close()
+}
 
-	if projectID == "" || sessionID == "" {
-		return "", errors.New(fmt.Sprintf("Received empty project (%s) or session (%s)", projectID, sessionID))
+func (n *GrpcNLU) SetSessionEntities(ctx context.Context, sessionID string, types []SessionEntityType) error {
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", n.ProjectID, sessionID)
+	for _, t := range types {
+		set := dialogflowpb.SessionEntityType{
+			Name:               sessionPath + "/entityTypes/" + t.Name,
+			EntityOverrideMode: dialogflowpb.SessionEntityType_ENTITY_OVERRIDE_MODE_OVERRIDE,
+		}
+		for _, e := range t.Entities {
+			set.Entities = append(set.Entities, &dialogflowpb.EntityType_Entity{Value: e.Value, Synonyms: e.Synonyms})
+		}
+		request := dialogflowpb.CreateSessionEntityTypeRequest{Parent: sessionPath, SessionEntityType: &set}
+		if _, err := n.entityTypes.CreateSessionEntityType(ctx, &request); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", projectID, sessionID)
-	textInput := dialogflowpb.TextInput{Text: text, LanguageCode: languageCode}
-	queryTextInput := dialogflowpb.QueryInput_Text{Text: &textInput}
-	queryInput := dialogflowpb.QueryInput{Input: &queryTextInput}
-	request := dialogflowpb.DetectIntentRequest{Session: sessionPath, QueryInput: &queryInput}
+func (n *GrpcNLU) DetectIntent(ctx context.Context, req *NLURequest) (*QueryResult, error) {
+	if n.ProjectID == "" || req.SessionID == "" {
+		return nil, errors.New(fmt.Sprintf("Received empty project (%s) or session (%s)", n.ProjectID, req.SessionID))
+	}
 
-	response, err := sessionClient.DetectIntent(ctx, &request)
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", n.ProjectID, req.SessionID)
+	var queryInput dialogflowpb.QueryInput
+	if req.Event != nil {
+		eventInput := dialogflowpb.EventInput{Name: req.Event.Name, LanguageCode: req.LanguageCode}
+		if req.Event.Parameters != nil {
+			eventInput.Parameters = mapToStruct(req.Event.Parameters)
+		}
+		queryInput.Input = &dialogflowpb.QueryInput_Event{Event: &eventInput}
+	} else if req.Audio != nil {
+		encoding, err := audioEncoding(req.AudioEncoding)
+		if err != nil {
+			return nil, err
+		}
+		audioConfig := dialogflowpb.InputAudioConfig{
+			AudioEncoding:   dialogflowpb.AudioEncoding(dialogflowpb.AudioEncoding_value[encoding]),
+			SampleRateHertz: req.SampleRate,
+			LanguageCode:    req.LanguageCode,
+		}
+		queryInput.Input = &dialogflowpb.QueryInput_AudioConfig{AudioConfig: &audioConfig}
+	} else {
+		textInput := dialogflowpb.TextInput{Text: req.Text, LanguageCode: req.LanguageCode}
+		queryInput.Input = &dialogflowpb.QueryInput_Text{Text: &textInput}
+	}
+	request := dialogflowpb.DetectIntentRequest{
+		Session:     sessionPath,
+		QueryParams: queryParamsToPb(req.Params.ForSession(sessionPath)),
+		QueryInput:  &queryInput,
+		InputAudio:  req.Audio,
+	}
+
+	response, err := n.client.DetectIntent(ctx, &request)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return queryResultFromPb(response.GetQueryResult()), nil
+}
+
+func queryResultFromPb(queryResult *dialogflowpb.QueryResult) *QueryResult {
+	res := &QueryResult{
+		QueryText:                queryResult.GetQueryText(),
+		Intent:                   queryResult.GetIntent().GetDisplayName(),
+		FulfillmentText:          queryResult.GetFulfillmentText(),
+		Parameters:               structToMap(queryResult.GetParameters()),
+		Confidence:               float64(queryResult.GetIntentDetectionConfidence()),
+		AllRequiredParamsPresent: queryResult.GetAllRequiredParamsPresent(),
+	}
+	for _, m := range queryResult.GetFulfillmentMessages() {
+		res.FulfillmentMessages = append(res.FulfillmentMessages, messageToMap(m))
+	}
+	for _, c := range queryResult.GetOutputContexts() {
+		res.OutputContexts = append(res.OutputContexts, QueryContext{
+			Name:          c.GetName(),
+			LifespanCount: c.GetLifespanCount(),
+			Parameters:    structToMap(c.GetParameters()),
+		})
 	}
+	return res
+}
 
-	queryResult := response.GetQueryResult()
-	fulfillmentText := queryResult.GetFulfillmentText()
-	return fulfillmentText, nil
+//messageToMap renders a fulfillment message the way the REST API does
+func messageToMap(m *dialogflowpb.Intent_Message) map[string]interface{} {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, m); err != nil {
+		return nil
+	}
+	var out map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &out)
+	return out
 }
 
-func main() {
-	response, err := DetectIntentText("container-a3c3c", "123", "Hello", "en")
+//StreamDetectIntent opens a StreamingDetectIntent call for a single
+//utterance; audio is sent in chunks through the returned stream
+func (n *GrpcNLU) StreamDetectIntent(ctx context.Context, req *NLURequest) (AudioStream, error) {
+	if n.ProjectID == "" || req.SessionID == "" {
+		return nil, errors.New(fmt.Sprintf("Received empty project (%s) or session (%s)", n.ProjectID, req.SessionID))
+	}
+	encoding, err := audioEncoding(req.AudioEncoding)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	stream, err := n.client.StreamingDetectIntent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	audioConfig := dialogflowpb.InputAudioConfig{
+		AudioEncoding:   dialogflowpb.AudioEncoding(dialogflowpb.AudioEncoding_value[encoding]),
+		SampleRateHertz: req.SampleRate,
+		LanguageCode:    req.LanguageCode,
+		SingleUtterance: true,
+	}
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", n.ProjectID, req.SessionID)
+	request := dialogflowpb.StreamingDetectIntentRequest{
+		Session:     sessionPath,
+		QueryParams: queryParamsToPb(req.Params.ForSession(sessionPath)),
+		QueryInput:  &dialogflowpb.QueryInput{Input: &dialogflowpb.QueryInput_AudioConfig{AudioConfig: &audioConfig}},
+	}
+	if err := stream.Send(&request); err != nil {
+		return nil, err
+	}
+	return &grpcAudioStream{stream: stream}, nil
+}
+
+type grpcAudioStream struct {
+	stream dialogflowpb.Sessions_StreamingDetectIntentClient
+}
+
+func (s *grpcAudioStream) Send(chunk []byte) error {
+	return s.stream.Send(&dialogflowpb.StreamingDetectIntentRequest{InputAudio: chunk})
+}
+
+func (s *grpcAudioStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+func (s *grpcAudioStream) Recv() (*StreamResult, error) {
+	for {
+		resp, err := s.stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if qr := resp.GetQueryResult(); qr != nil {
+			return &StreamResult{Transcript: qr.GetQueryText(), Final: true, Result: queryResultFromPb(qr)}, nil
+		}
+		if rr := resp.GetRecognitionResult(); rr != nil && rr.GetMessageType() == dialogflowpb.StreamingRecognitionResult_TRANSCRIPT {
+			return &StreamResult{Transcript: rr.GetTranscript(), Final: rr.GetIsFinal()}, nil
+		}
+	}
+}
+
+func queryParamsToPb(p *QueryParams) *dialogflowpb.QueryParameters {
+	if p == nil {
+		return nil
+	}
+	qp := &dialogflowpb.QueryParameters{TimeZone: p.TimeZone, ResetContexts: p.ResetContexts}
+	if p.GeoLocation != nil {
+		qp.GeoLocation = &latlng.LatLng{Latitude: p.GeoLocation.Latitude, Longitude: p.GeoLocation.Longitude}
+	}
+	for _, c := range p.Contexts {
+		qp.Contexts = append(qp.Contexts, &dialogflowpb.Context{
+			Name:          c.Name,
+			LifespanCount: c.LifespanCount,
+			Parameters:    mapToStruct(c.Parameters),
+		})
+	}
+	if p.Payload != nil {
+		qp.Payload = mapToStruct(p.Payload)
+	}
+	return qp
+}
+
+//clientOptions points a Dialogflow client at endpoint, authenticated with
+//creds, or without TLS or credentials when insecure is set
+func clientOptions(endpoint string, insecure bool, creds oauth2.TokenSource) []option.ClientOption {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()))
+	} else if creds != nil {
+		opts = append(opts, option.WithTokenSource(creds))
+	}
+	return opts
+}
+
+//structToMap converts a protobuf Struct into the same shape encoding/json
+//produces for the REST response
+func structToMap(s *structpb.Struct) map[string]interface{} {
+	m := make(map[string]interface{})
+	for k, v := range s.GetFields() {
+		m[k] = valueToInterface(v)
+	}
+	return m
+}
+
+func valueToInterface(v *structpb.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		return k.NumberValue
+	case *structpb.Value_StringValue:
+		return k.StringValue
+	case *structpb.Value_BoolValue:
+		return k.BoolValue
+	case *structpb.Value_StructValue:
+		return structToMap(k.StructValue)
+	case *structpb.Value_ListValue:
+		l := make([]interface{}, 0, len(k.ListValue.GetValues()))
+		for _, e := range k.ListValue.GetValues() {
+			l = append(l, valueToInterface(e))
+		}
+		return l
+	}
+	return nil
+}
+
+//mapToStruct is the inverse of structToMap
+func mapToStruct(m map[string]interface{}) *structpb.Struct {
+	s := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for k, v := range m {
+		s.Fields[k] = interfaceToValue(v)
+	}
+	return s
+}
+
+func interfaceToValue(v interface{}) *structpb.Value {
+	switch t := v.(type) {
+	case float64:
+		return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: t}}
+	case int:
+		return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(t)}}
+	case string:
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: t}}
+	case bool:
+		return &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: t}}
+	case map[string]interface{}:
+		return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: mapToStruct(t)}}
+	case []interface{}:
+		l := &structpb.ListValue{}
+		for _, e := range t {
+			l.Values = append(l.Values, interfaceToValue(e))
+		}
+		return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: l}}
 	}
-	fmt.Printf("Output: %s\n", response)
+	return &structpb.Value{Kind: &structpb.Value_NullValue{}}
 }
@@ -0,0 +1,49 @@
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+//AudioPreamble is the one line JSON preamble of a binary audio frame. The
+//raw audio follows the newline that ends it.
+type AudioPreamble struct {
+	ID         string          `json:"id,omitempty"`
+	Header     json.RawMessage `json:"header"`   // as in a text frame
+	Encoding   string          `json:"encoding"` // "LINEAR16" or "OGG_OPUS"
+	SampleRate int32           `json:"sampleRate"`
+}
+
+func ParseAudioFrame(frame []byte) (*AudioPreamble, []byte, error) {
+	i := bytes.IndexByte(frame, '\n')
+	if i < 0 {
+		return nil, nil, errors.New("audio frame has no preamble")
+	}
+	var p AudioPreamble
+	if err := decodeStrict(frame[:i], &p); err != nil {
+		return nil, nil, err
+	}
+	if _, err := audioEncoding(p.Encoding); err != nil {
+		return nil, nil, err
+	}
+	if p.SampleRate <= 0 && p.Encoding == "LINEAR16" {
+		return nil, nil, errors.New("audio frame has no sample rate")
+	}
+	return &p, frame[i+1:], nil
+}
+
+//AudioRef identifies a binary frame of synthesized talkback. It is sent as
+//data.audio in the JSON Output and as the preamble of the binary frame that
+//follows it.
+type AudioRef struct {
+	ID       int    `json:"id"`
+	Encoding string `json:"encoding"`
+}
+
+func AudioFrame(ref *AudioRef, audio []byte) []byte {
+	b, _ := json.Marshal(ref)
+	return append(append(b, '\n'), audio...)
+}
@@ -0,0 +1,103 @@
+// +build ignore
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//authProtocolPrefix carries the device credential as a WebSocket subprotocol,
+//for clients like browsers that cannot set an Authorization header
+const authProtocolPrefix = "chipotle.auth."
+
+//DeviceAuth authenticates a device when its WebSocket is upgraded. A device
+//presents either its API key or a token signed with Secret, as
+//"Authorization: Bearer <credential>" or as the subprotocol
+//"chipotle.auth.<credential>". Either way the device must be enabled in the
+//Registry.
+type DeviceAuth struct {
+	Secret         []byte // HMAC key of signed tokens, nil disables them
+	Registry       *Registry
+	AllowAnonymous bool // accept connections without a credential
+}
+
+//Authenticate returns the registered device r's credential belongs to, and
+//the subprotocol to accept when it came as one. An anonymous connection has
+//a nil device.
+func (a *DeviceAuth) Authenticate(r *http.Request) (device *Device, protocol string, err error) {
+	credential := ""
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		credential = strings.TrimPrefix(h, "Bearer ")
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, authProtocolPrefix) {
+			credential, protocol = strings.TrimPrefix(p, authProtocolPrefix), p
+			break
+		}
+	}
+	if credential == "" {
+		if a.AllowAnonymous {
+			return nil, "", nil
+		}
+		return nil, "", errors.New("no device credential")
+	}
+	var d Device
+	if strings.Contains(credential, ".") {
+		var id string
+		id, err = a.verifyToken(credential)
+		if err != nil {
+			return nil, "", err
+		}
+		d, err = a.Registry.Lookup(id)
+	} else {
+		d, err = a.Registry.LookupKey(credential)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &d, protocol, nil
+}
+
+//SignDeviceToken issues a token for device, "<device>.<expiry>.<signature>"
+func SignDeviceToken(secret []byte, device string, expiry time.Time) string {
+	payload := device + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + tokenSignature(secret, payload)
+}
+
+func tokenSignature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *DeviceAuth) verifyToken(token string) (string, error) {
+	if a.Secret == nil {
+		return "", errors.New("signed device tokens are disabled")
+	}
+	i := strings.LastIndex(token, ".")
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(tokenSignature(a.Secret, payload))) {
+		return "", errors.New("bad device token signature")
+	}
+	j := strings.LastIndex(payload, ".")
+	if j < 0 {
+		return "", errors.New("malformed device token")
+	}
+	expiry, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed device token")
+	}
+	if time.Now().Unix() > expiry {
+		return "", errors.New("device token expired")
+	}
+	return payload[:j], nil
+}
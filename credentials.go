@@ -0,0 +1,166 @@
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+//tokens are refreshed this long before they expire
+const tokenRefreshMargin = 5 * time.Minute
+
+//failed background refreshes are retried after this long
+const tokenRetryInterval = 30 * time.Second
+
+//Credentials mints Google access tokens in process from a service account
+//key or the application default credentials, and caches them until shortly
+//before expiry. It is an oauth2.TokenSource for the gRPC client, AccessToken
+//is the Token func of the REST providers.
+type Credentials struct {
+	newSource func() oauth2.TokenSource // a fresh source mints a new token
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	err   error // why no source could be built
+}
+
+//NewCredentials reads keyFile, a service account JSON key or an
+//application default credentials file, or finds the application default
+//credentials when keyFile is empty. Failing to load them is not fatal, every
+//token request then returns the error.
+func NewCredentials(ctx context.Context, keyFile string) *Credentials {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Timeout: 10 * time.Second})
+	c := &Credentials{}
+	var data []byte
+	var err error
+	if keyFile != "" {
+		data, err = ioutil.ReadFile(keyFile)
+	} else {
+		var found *google.Credentials
+		found, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		if err == nil && found.JSON == nil {
+			//on GCE the metadata server mints the tokens
+			c.newSource = func() oauth2.TokenSource { return google.ComputeTokenSource("", cloudPlatformScope) }
+			return c
+		}
+		if err == nil {
+			data = found.JSON
+		}
+	}
+	if err == nil {
+		c.newSource, err = tokenSourceFunc(ctx, data)
+	}
+	if err != nil {
+		c.err = errors.New(fmt.Sprintf("credentials: %s", err))
+	}
+	return c
+}
+
+func tokenSourceFunc(ctx context.Context, data []byte) (func() oauth2.TokenSource, error) {
+	var f struct {
+		Type         string `json:"type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	switch f.Type {
+	case "service_account":
+		conf, err := google.JWTConfigFromJSON(data, cloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		return func() oauth2.TokenSource { return conf.TokenSource(ctx) }, nil
+	case "authorized_user":
+		conf := &oauth2.Config{
+			ClientID:     f.ClientID,
+			ClientSecret: f.ClientSecret,
+			Endpoint:     google.Endpoint,
+			Scopes:       []string{cloudPlatformScope},
+		}
+		return func() oauth2.TokenSource {
+			return conf.TokenSource(ctx, &oauth2.Token{RefreshToken: f.RefreshToken})
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported credentials type %q", f.Type))
+}
+
+//Token returns the cached token, minting a new one when it is missing or
+//about to expire
+func (c *Credentials) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	t := c.token
+	c.mu.Unlock()
+	if t != nil && time.Until(t.Expiry) > tokenRefreshMargin {
+		return t, nil
+	}
+	return c.refresh()
+}
+
+//AccessToken returns the bearer token for a REST request
+func (c *Credentials) AccessToken() (string, error) {
+	t, err := c.Token()
+	if err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+//refresh mints a new token and caches it. The token endpoint is called
+//without holding c.mu, so turns with a cached token never wait for it.
+func (c *Credentials) refresh() (*oauth2.Token, error) {
+	if c.newSource == nil {
+		return nil, c.err
+	}
+	t, err := c.newSource().Token()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("credentials: %s", err))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	//of two refreshes at once keep the token that lasts longer
+	if c.token == nil || t.Expiry.IsZero() || t.Expiry.After(c.token.Expiry) {
+		c.token = t
+	}
+	return t, nil
+}
+
+//Run refreshes the token in the background shortly before it expires, so
+//turns never wait for one, until ctx is done
+func (c *Credentials) Run(ctx context.Context) {
+	if c.newSource == nil {
+		log.Println(c.err)
+		return
+	}
+	for {
+		t, err := c.refresh()
+		wait := tokenRetryInterval
+		if err != nil {
+			log.Println(err)
+		} else if t.Expiry.IsZero() {
+			return
+		} else if d := time.Until(t.Expiry) - tokenRefreshMargin; d > wait {
+			wait = d
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	sj "github.com/bitly/go-simplejson"
+)
+
+//CxPage maps a Dialogflow CX page onto the ES intent and fulfillment step
+//that HeaderProcess understands
+type CxPage struct {
+	Intent string `json:"intent"`
+	Step   string `json:"step"` // empty passes the CX response text through
+}
+
+//CxPages is keyed by page display name
+type CxPages map[string]CxPage
+
+func LoadCxPages(path string) (CxPages, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p CxPages
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	return p, nil
+}
+
+//CxNLU talks to a Dialogflow CX (v3) agent through the REST :detectIntent
+//endpoint and maps the current page back onto v2 intents
+type CxNLU struct {
+	ProjectID string
+	Location  string
+	AgentID   string
+	BasePath  string
+	Pages     CxPages
+	Client    *http.Client
+	Token     func() (string, error) // nil sends no Authorization header
+
+	mu            sync.Mutex
+	entityTypeIDs map[string]string // the agent's entity type ids by display name
+}
+
+func NewCxNLU(projectID, location, agentID, basePath string, pages CxPages) *CxNLU {
+	if basePath == "" {
+		if location == "global" {
+			basePath = "https://dialogflow.googleapis.com/v3/"
+		} else {
+			basePath = fmt.Sprintf("https://%s-dialogflow.googleapis.com/v3/", location)
+		}
+	}
+	return &CxNLU{
+		ProjectID: projectID,
+		Location:  location,
+		AgentID:   agentID,
+		BasePath:  basePath,
+		Pages:     pages,
+		Client:    &http.Client{},
+	}
+}
+
+func (n *CxNLU) DetectIntent(ctx context.Context, req *NLURequest) (*QueryResult, error) {
+	if n.AgentID == "" || req.SessionID == "" {
+		return nil, errors.New(fmt.Sprintf("Received empty agent (%s) or session (%s)", n.AgentID, req.SessionID))
+	}
+	sessionPath := fmt.Sprintf("projects/%s/locations/%s/agents/%s/sessions/%s", n.ProjectID, n.Location, n.AgentID, req.SessionID)
+
+	queryInput := map[string]interface{}{"languageCode": req.LanguageCode}
+	if req.Event != nil {
+		queryInput["event"] = map[string]interface{}{"event": req.Event.Name}
+	} else if req.Audio != nil {
+		encoding, err := audioEncoding(req.AudioEncoding)
+		if err != nil {
+			return nil, err
+		}
+		queryInput["audio"] = map[string]interface{}{
+			"config": map[string]interface{}{
+				"audioEncoding":   encoding,
+				"sampleRateHertz": req.SampleRate,
+			},
+			"audio": req.Audio,
+		}
+	} else {
+		queryInput["text"] = map[string]interface{}{"text": req.Text}
+	}
+	body := map[string]interface{}{"queryInput": queryInput}
+	if p := req.Params; p != nil || req.Event != nil {
+		//CX has no contexts, only the time zone, location and payload carry
+		//over. Event parameters become session parameters.
+		if p == nil {
+			p = &QueryParams{}
+		}
+		queryParams := map[string]interface{}{}
+		if req.Event != nil && req.Event.Parameters != nil {
+			queryParams["parameters"] = req.Event.Parameters
+		}
+		if p.TimeZone != "" {
+			queryParams["timeZone"] = p.TimeZone
+		}
+		if p.GeoLocation != nil {
+			queryParams["geoLocation"] = p.GeoLocation
+		}
+		if p.Payload != nil {
+			queryParams["payload"] = p.Payload
+		}
+		body["queryParams"] = queryParams
+	}
+	jsonValue, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", n.BasePath+sessionPath+":detectIntent", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+	if n.Token != nil {
+		token, err := n.Token()
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Add("Authorization", "Bearer "+token)
+	}
+	r.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := n.Client.Do(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("The HTTP request failed with error %s", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("cx detectIntent returned %s: %s", resp.Status, data))
+	}
+
+	js, err := sj.NewJson(data)
+	if err != nil {
+		return nil, err
+	}
+	qr := js.Get("queryResult")
+	var texts []string
+	for i := range qr.Get("responseMessages").MustArray() {
+		for _, t := range qr.Get("responseMessages").GetIndex(i).Get("text").Get("text").MustStringArray() {
+			texts = append(texts, t)
+		}
+	}
+
+	var extra struct {
+		QueryResult struct {
+			ResponseMessages []map[string]interface{} `json:"responseMessages"`
+		} `json:"queryResult"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, err
+	}
+
+	queryText := qr.Get("text").MustString()
+	if queryText == "" {
+		queryText = qr.Get("transcript").MustString()
+	}
+	res := &QueryResult{
+		QueryText:           queryText,
+		Intent:              qr.Get("match").Get("intent").Get("displayName").MustString(),
+		FulfillmentText:     strings.Join(texts, " "),
+		FulfillmentMessages: extra.QueryResult.ResponseMessages,
+		Parameters:          qr.Get("parameters").MustMap(),
+		Confidence:          qr.Get("match").Get("confidence").MustFloat64(),
+		//CX pages only advance once the form is filled
+		AllRequiredParamsPresent: true,
+	}
+	if page, ok := n.Pages[qr.Get("currentPage").Get("displayName").MustString()]; ok {
+		res.Intent = page.Intent
+		if page.Step != "" {
+			res.FulfillmentText = page.Step
+		}
+	}
+	return res, nil
+}
+
+//SetSessionEntities creates the session's entity types through the v3
+//POST {session}/entityTypes. CX names them after the agent's entity type id,
+//types the agent does not have are skipped.
+func (n *CxNLU) SetSessionEntities(ctx context.Context, sessionID string, types []SessionEntityType) error {
+	sessionPath := fmt.Sprintf("projects/%s/locations/%s/agents/%s/sessions/%s", n.ProjectID, n.Location, n.AgentID, sessionID)
+	var byID []SessionEntityType
+	var missing []string
+	for _, t := range types {
+		id, err := n.entityTypeID(ctx, t.Name)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			missing = append(missing, t.Name)
+			continue
+		}
+		byID = append(byID, SessionEntityType{Name: id, Entities: t.Entities})
+	}
+	if err := createSessionEntityTypes(ctx, n.Client, n.Token, n.BasePath, sessionPath, byID); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("agent has no entity types %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+//entityTypeID returns the id of the agent's entity type named display, or
+//"" when it has none. The agent's entity types are listed on first use and
+//again when a name is not among them.
+func (n *CxNLU) entityTypeID(ctx context.Context, display string) (string, error) {
+	n.mu.Lock()
+	id, ok := n.entityTypeIDs[display]
+	n.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	ids, err := n.listEntityTypes(ctx)
+	if err != nil {
+		return "", err
+	}
+	n.mu.Lock()
+	n.entityTypeIDs = ids
+	n.mu.Unlock()
+	return ids[display], nil
+}
+
+//listEntityTypes maps the display name of every agent entity type to its id
+//through GET {agent}/entityTypes
+func (n *CxNLU) listEntityTypes(ctx context.Context) (map[string]string, error) {
+	agentPath := fmt.Sprintf("projects/%s/locations/%s/agents/%s", n.ProjectID, n.Location, n.AgentID)
+	ids := make(map[string]string)
+	pageToken := ""
+	for {
+		r, err := http.NewRequest("GET", n.BasePath+agentPath+"/entityTypes?pageToken="+url.QueryEscape(pageToken), nil)
+		if err != nil {
+			return nil, err
+		}
+		r = r.WithContext(ctx)
+		if n.Token != nil {
+			token, err := n.Token()
+			if err != nil {
+				return nil, err
+			}
+			r.Header.Add("Authorization", "Bearer "+token)
+		}
+		resp, err := n.Client.Do(r)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("The HTTP request failed with error %s", err))
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(fmt.Sprintf("cx entityTypes returned %s: %s", resp.Status, data))
+		}
+		var list struct {
+			EntityTypes []struct {
+				Name        string `json:"name"`
+				DisplayName string `json:"displayName"`
+			} `json:"entityTypes"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, t := range list.EntityTypes {
+			ids[t.DisplayName] = t.Name[strings.LastIndex(t.Name, "/")+1:]
+		}
+		if list.NextPageToken == "" {
+			return ids, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
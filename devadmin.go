@@ -0,0 +1,74 @@
+// +build ignore
+
+//devadmin manages the device registry the server checks every connection
+//against:
+//
+//	go run devadmin.go registry.go provision -id 358165081199845 -owner alice -firmware 1.4.2 -lang en
+//	go run devadmin.go registry.go list
+//	go run devadmin.go registry.go revoke -id 358165081199845
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: devadmin [-devices file] provision|list|revoke [flags]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	devicesPath := flag.String("devices", "conf/devices.json", "device registry")
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(0)
+	if flag.NArg() < 1 {
+		usage()
+	}
+	registry, err := OpenRegistry(*devicesPath)
+	if err != nil {
+		log.Fatal("devices:", err)
+	}
+
+	cmd := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	id := cmd.String("id", "", "device id, header[0]")
+	switch flag.Arg(0) {
+	case "provision":
+		var d Device
+		cmd.StringVar(&d.Owner, "owner", "", "owner of the device")
+		cmd.StringVar(&d.Firmware, "firmware", "", "firmware version")
+		cmd.StringVar(&d.Lang, "lang", "", "language, empty to negotiate per connection")
+		cmd.Parse(flag.Args()[1:])
+		d.ID = *id
+		key, err := registry.Provision(d)
+		if err != nil {
+			log.Fatal("provision:", err)
+		}
+		fmt.Printf("provisioned %s, API key %s\n", d.ID, key)
+	case "list":
+		cmd.Parse(flag.Args()[1:])
+		list, err := registry.List()
+		if err != nil {
+			log.Fatal("list:", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOWNER\tFIRMWARE\tLANG\tENABLED\tPROVISIONED")
+		for _, d := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", d.ID, d.Owner, d.Firmware, d.Lang, d.Enabled, d.Provisioned.Format("2006-01-02"))
+		}
+		w.Flush()
+	case "revoke":
+		cmd.Parse(flag.Args()[1:])
+		if err := registry.Revoke(*id); err != nil {
+			log.Fatal("revoke:", err)
+		}
+		fmt.Printf("revoked %s\n", *id)
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,204 @@
+// +build ignore
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Step is what a reply does to the device: the state it moves to, the
+//catalog prompt it speaks instead of Dialogflow's fulfillment text and the
+//entity it is sent instead of Dialogflow's parameters. A missing prompt or
+//entity passes Dialogflow's through.
+//
+//Entity values are literals, except strings starting with "$" which name a
+//parameter, optionally through a filter: "$address", "$time|clock".
+type Step struct {
+	Next   float64                `json:"next"`
+	Prompt string                 `json:"prompt"`
+	Entity map[string]interface{} `json:"entity"`
+}
+
+//IntentRules map an intent's fulfillment text to its Step. An intent without
+//steps, or a fulfillment text without one, gets the intent's own Step.
+type IntentRules struct {
+	Step
+	Steps map[string]Step `json:"steps"`
+}
+
+//Dialog is the state machine of HeaderProcess, see conf/dialog.json
+type Dialog struct {
+	States  []float64              `json:"states"`  // states without a prompt, besides the ones in code
+	Prompts map[string]string      `json:"prompts"` // state, spoken once the device confirms it reached it
+	Intents map[string]IntentRules `json:"intents"`
+
+	prompts map[float64]string
+	known   map[float64]bool
+}
+
+//entityFilters format a parameter for an entity
+var entityFilters = map[string]func(v interface{}) interface{}{
+	//an RFC 3339 date time as "3:04 PM"
+	"clock": func(v interface{}) interface{} {
+		t, _ := time.Parse(time.RFC3339, fmt.Sprintf("%v", v))
+		return t.Format("3:04 PM")
+	},
+}
+
+//LoadDialog reads and checks a dialog definition, whose prompts must be in
+//catalog
+func LoadDialog(path string, catalog Catalog) (*Dialog, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d Dialog
+	if err := decodeStrict(data, &d); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	d.prompts = make(map[float64]string)
+	d.known = map[float64]bool{StateAwaitPrompt: true}
+	for _, s := range pushEvents {
+		d.known[s] = true
+	}
+	for _, s := range d.States {
+		d.known[s] = true
+	}
+	for k, prompt := range d.Prompts {
+		s, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: prompts: %q is not a state", path, k))
+		}
+		if !catalog.Has(prompt) {
+			return nil, errors.New(fmt.Sprintf("%s: prompts: %s: no prompt %q in the catalog", path, k, prompt))
+		}
+		d.prompts[s], d.known[s] = prompt, true
+	}
+	check := func(intent, step string, st Step) error {
+		d.known[st.Next] = true
+		if st.Prompt != "" && !catalog.Has(st.Prompt) {
+			return errors.New(fmt.Sprintf("%s: %s %q: no prompt %q in the catalog", path, intent, step, st.Prompt))
+		}
+		for k, v := range st.Entity {
+			ref, ok := v.(string)
+			if !ok || !strings.HasPrefix(ref, "$") {
+				continue
+			}
+			if i := strings.Index(ref, "|"); i >= 0 {
+				if _, ok := entityFilters[ref[i+1:]]; !ok {
+					return errors.New(fmt.Sprintf("%s: %s %q: entity %s: unknown filter %q", path, intent, step, k, ref[i+1:]))
+				}
+			}
+		}
+		return nil
+	}
+	for intent, r := range d.Intents {
+		if err := check(intent, "", r.Step); err != nil {
+			return nil, err
+		}
+		for step, st := range r.Steps {
+			if err := check(intent, step, st); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &d, nil
+}
+
+//Known reports whether a device can be in state s
+func (d *Dialog) Known(s float64) bool {
+	return d.known[s]
+}
+
+//Prompt is the prompt of state s
+func (d *Dialog) Prompt(s float64) (string, bool) {
+	p, ok := d.prompts[s]
+	return p, ok
+}
+
+//Step returns the Step of intent answered with fulfillment text speech
+func (d *Dialog) Step(intent, speech string) Step {
+	r := d.Intents[intent]
+	if st, ok := r.Steps[speech]; ok {
+		return st
+	}
+	return r.Step
+}
+
+//entity builds st's entity from Dialogflow's parameters
+func (st Step) entity(params map[string]interface{}) map[string]interface{} {
+	if st.Entity == nil {
+		return params
+	}
+	entity := make(map[string]interface{}, len(st.Entity))
+	for k, v := range st.Entity {
+		ref, ok := v.(string)
+		if !ok || !strings.HasPrefix(ref, "$") {
+			entity[k] = v
+			continue
+		}
+		name, filter := ref[1:], ""
+		if i := strings.Index(name, "|"); i >= 0 {
+			name, filter = name[:i], name[i+1:]
+		}
+		entity[k] = params[name]
+		if filter != "" {
+			entity[k] = entityFilters[filter](params[name])
+		}
+	}
+	return entity
+}
+
+//DialogStore is the dialog definition in Path, reloaded when the file
+//changes. A definition that fails to load is logged and the previous one
+//kept.
+type DialogStore struct {
+	Path    string
+	Catalog Catalog
+
+	mu      sync.Mutex
+	dialog  *Dialog
+	modTime time.Time
+	size    int64
+}
+
+//OpenDialog loads path, which must be a valid definition with its prompts
+//in catalog
+func OpenDialog(path string, catalog Catalog) (*DialogStore, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := LoadDialog(path, catalog)
+	if err != nil {
+		return nil, err
+	}
+	return &DialogStore{Path: path, Catalog: catalog, dialog: d, modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+//Current returns the definition, rereading the file if it changed
+func (s *DialogStore) Current() *Dialog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(s.Path)
+	if err != nil || fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.dialog
+	}
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	d, err := LoadDialog(s.Path, s.Catalog)
+	if err != nil {
+		log.Println("dialog: keeping the previous definition:", err)
+		return s.dialog
+	}
+	log.Println("dialog: reloaded", s.Path)
+	s.dialog = d
+	return d
+}
@@ -0,0 +1,55 @@
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+//SessionEntityTyper is implemented by providers that can override entity
+//types for a single session, so the agent recognizes names only this user
+//has, like their favorite store or a nickname for a past order
+type SessionEntityTyper interface {
+	SetSessionEntities(ctx context.Context, sessionID string, types []SessionEntityType) error
+}
+
+//SessionEntityType overrides the agent's entity type Name for one session
+type SessionEntityType struct {
+	Name     string
+	Entities []Entity
+}
+
+type Entity struct {
+	Value    string   `json:"value"`
+	Synonyms []string `json:"synonyms"`
+}
+
+//Profile is what the server knows about a device's user, as entities keyed
+//by entity type name (e.g. "favorite-store", "past-order")
+type Profile map[string][]Entity
+
+func LoadProfiles(path string) (map[string]Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p map[string]Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	return p, nil
+}
+
+func (p Profile) EntityTypes() []SessionEntityType {
+	var types []SessionEntityType
+	for name, entities := range p {
+		if len(entities) > 0 {
+			types = append(types, SessionEntityType{Name: name, Entities: entities})
+		}
+	}
+	return types
+}
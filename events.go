@@ -0,0 +1,35 @@
+// +build ignore
+
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+//StateAwaitPrompt is the next state sent after a device acknowledged an
+//action: it stays on its page and waits for the user's next utterance
+const StateAwaitPrompt = 9999
+
+//ActionEvent translates the result a device reports after executing an
+//action into a Dialogflow event: "actionTrue" becomes ACTION_TRUE and
+//"itemNotFound: CHICKENADD RICE" becomes ITEM_NOT_FOUND with the text after
+//the colon as its detail parameter. The device's state goes along too.
+func ActionEvent(result string, state float64) *Event {
+	name, detail := result, ""
+	if i := strings.Index(result, ":"); i >= 0 {
+		name, detail = result[:i], strings.TrimSpace(result[i+1:])
+	}
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(name) {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	params := map[string]interface{}{"state": state}
+	if detail != "" {
+		params["detail"] = detail
+	}
+	return &Event{Name: b.String(), Parameters: params}
+}
@@ -0,0 +1,637 @@
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
+	"google.golang.org/grpc"
+)
+
+//Scenario drives the fake Dialogflow agent. Turns are tried in file order,
+//the first one whose utterance matches and whose contexts are all active wins.
+type Scenario struct {
+	Turns   []*ScenarioTurn `json:"turns"`
+	Default ScenarioTurn    `json:"default"`
+}
+
+type ScenarioTurn struct {
+	Utterances      []string               `json:"utterances"` // case insensitive regexps, "@type" matches a session entity
+	Events          []string               `json:"events"`
+	Contexts        []string               `json:"contexts"`
+	Intent          string                 `json:"intent"`
+	FulfillmentText string                 `json:"fulfillmentText"`
+	Parameters      map[string]interface{} `json:"parameters"` // "$1" expands to a capture group, "@type" to the entity value
+	OutputContexts  []string               `json:"outputContexts"`
+	Confidence      float64                `json:"confidence"`
+	Page            string                 `json:"page"` // CX current page display name
+
+	patterns []*regexp.Regexp
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	for _, t := range s.Turns {
+		for _, u := range t.Utterances {
+			//utterances with entity placeholders are compiled per session
+			re, err := regexp.Compile("(?i)" + entityPlaceholder.ReplaceAllString(u, "x"))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: intent %s: %s", path, t.Intent, err))
+			}
+			if entityPlaceholder.MatchString(u) {
+				re = nil
+			}
+			t.patterns = append(t.patterns, re)
+		}
+	}
+	return &s, nil
+}
+
+var entityPlaceholder = regexp.MustCompile(`@([A-Za-z0-9_-]+)`)
+
+//FakeDialogflow answers the v2 :detectIntent REST call and the gRPC Sessions
+//service from a Scenario, keeping active contexts per session. It has no
+//speech recognizer: audio input is taken to be the UTF-8 transcript itself.
+type FakeDialogflow struct {
+	scenario *Scenario
+
+	mu       sync.Mutex
+	contexts map[string][]string
+	entities map[string]map[string][]Entity // session entity types by session and type
+
+	entityTypes map[string]string // CX entity type display names by id, one per "@type" in the scenario
+}
+
+func NewFakeDialogflow(s *Scenario) *FakeDialogflow {
+	f := &FakeDialogflow{
+		scenario:    s,
+		contexts:    make(map[string][]string),
+		entities:    make(map[string]map[string][]Entity),
+		entityTypes: make(map[string]string),
+	}
+	ids := make(map[string]bool)
+	for _, t := range s.Turns {
+		for _, u := range t.Utterances {
+			for _, m := range entityPlaceholder.FindAllStringSubmatch(u, -1) {
+				if !ids[m[1]] {
+					ids[m[1]] = true
+					f.entityTypes[fmt.Sprintf("%08d-fake", len(ids))] = m[1]
+				}
+			}
+		}
+	}
+	return f
+}
+
+//StartFakeDialogflow serves the scenario at path over REST on httpAddr and
+//over gRPC on grpcAddr
+func StartFakeDialogflow(path, httpAddr, grpcAddr string) (*FakeDialogflow, error) {
+	s, err := LoadScenario(path)
+	if err != nil {
+		return nil, err
+	}
+	f := NewFakeDialogflow(s)
+
+	hl, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	gl, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		hl.Close()
+		return nil, err
+	}
+	gs := grpc.NewServer()
+	dialogflowpb.RegisterSessionsServer(gs, f)
+	dialogflowpb.RegisterSessionEntityTypesServer(gs, &fakeSessionEntityTypes{f: f})
+
+	go func() {
+		log.Println("fake dialogflow:", http.Serve(hl, f))
+	}()
+	go func() {
+		log.Println("fake dialogflow:", gs.Serve(gl))
+	}()
+	log.Printf("fake dialogflow serving %s on %s (rest) and %s (grpc)", path, httpAddr, grpcAddr)
+	return f, nil
+}
+
+//Match finds the scenario turn for text, or for event when it is set, in
+//session and advances the session's contexts
+func (f *FakeDialogflow) Match(session, text, event string) (*QueryResult, *ScenarioTurn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	active := f.contexts[session]
+	for _, t := range f.scenario.Turns {
+		if !hasContexts(active, t.Contexts) {
+			continue
+		}
+		if event != "" {
+			for _, e := range t.Events {
+				if e != event {
+					continue
+				}
+				if t.OutputContexts != nil {
+					f.contexts[session] = t.OutputContexts
+				}
+				return t.result(event, func(s string) string { return s }), t
+			}
+			continue
+		}
+		for i, re := range t.patterns {
+			var types map[string]string
+			if re == nil {
+				re, types = f.entityPattern(session, t.Utterances[i])
+			}
+			m := re.FindStringSubmatchIndex(text)
+			if m == nil {
+				continue
+			}
+			if t.OutputContexts != nil {
+				f.contexts[session] = t.OutputContexts
+			}
+			values := f.entityValues(session, re, types, text, m)
+			return t.result(text, func(s string) string {
+				if v, ok := values[s]; ok {
+					return v
+				}
+				return string(re.ExpandString(nil, s, text, m))
+			}), t
+		}
+	}
+	return f.scenario.Default.result(text, func(s string) string { return s }), &f.scenario.Default
+}
+
+//entityPattern compiles an utterance against the session's entities; each
+//"@type" becomes a named group of that type's values and synonyms. types maps
+//group names back to entity types.
+func (f *FakeDialogflow) entityPattern(session, utterance string) (*regexp.Regexp, map[string]string) {
+	types := make(map[string]string)
+	expr := entityPlaceholder.ReplaceAllStringFunc(utterance, func(p string) string {
+		name := p[1:]
+		var alts []string
+		for _, e := range f.entities[session][name] {
+			alts = append(alts, regexp.QuoteMeta(e.Value))
+			for _, syn := range e.Synonyms {
+				alts = append(alts, regexp.QuoteMeta(syn))
+			}
+		}
+		if len(alts) == 0 {
+			alts = []string{"\\x00"} //no entities, never matches
+		}
+		group := fmt.Sprintf("entity%d", len(types))
+		types[group] = name
+		return "(?P<" + group + ">" + strings.Join(alts, "|") + ")"
+	})
+	return regexp.MustCompile("(?i)" + expr), types
+}
+
+//entityValues maps "@type" to the canonical value of the entity matched for it
+func (f *FakeDialogflow) entityValues(session string, re *regexp.Regexp, types map[string]string, text string, m []int) map[string]string {
+	values := make(map[string]string)
+	for i, group := range re.SubexpNames() {
+		name, ok := types[group]
+		if !ok || m[2*i] < 0 {
+			continue
+		}
+		said := text[m[2*i]:m[2*i+1]]
+		for _, e := range f.entities[session][name] {
+			if strings.EqualFold(said, e.Value) {
+				values["@"+name] = e.Value
+			}
+			for _, syn := range e.Synonyms {
+				if strings.EqualFold(said, syn) {
+					values["@"+name] = e.Value
+				}
+			}
+		}
+	}
+	return values
+}
+
+//SetEntities overrides entity type name for session
+func (f *FakeDialogflow) SetEntities(session, name string, entities []Entity) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.entities[session] == nil {
+		f.entities[session] = make(map[string][]Entity)
+	}
+	f.entities[session][name] = entities
+}
+
+//ApplyContexts activates the input contexts of a request, named by their
+//full path, after clearing the active ones when reset is set
+func (f *FakeDialogflow) ApplyContexts(session string, names []string, reset bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var active []string
+	if !reset {
+		active = f.contexts[session]
+	}
+	for _, n := range names {
+		active = append(active, n[strings.LastIndex(n, "/")+1:])
+	}
+	f.contexts[session] = active
+}
+
+func (f *FakeDialogflow) Contexts(session string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contexts[session]
+}
+
+func hasContexts(active, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, a := range active {
+			if a == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *ScenarioTurn) result(text string, expand func(string) string) *QueryResult {
+	params := make(map[string]interface{})
+	for k, v := range t.Parameters {
+		params[k] = expandValue(v, expand)
+	}
+	confidence := t.Confidence
+	if confidence == 0 {
+		confidence = 1
+	}
+	return &QueryResult{
+		QueryText:       text,
+		Intent:          t.Intent,
+		FulfillmentText: t.FulfillmentText,
+		Parameters:      params,
+		Confidence:      confidence,
+	}
+}
+
+func expandValue(v interface{}, expand func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return expand(t)
+	case []interface{}:
+		l := make([]interface{}, 0, len(t))
+		for _, e := range t {
+			l = append(l, expandValue(e, expand))
+		}
+		return l
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range t {
+			m[k] = expandValue(e, expand)
+		}
+		return m
+	}
+	return v
+}
+
+//ServeHTTP implements POST /v2/{session}:detectIntent, the CX
+//POST /v3/{session}:detectIntent and GET /v3/{agent}/entityTypes, session
+//entity types and Text-to-Speech POST /v1/text:synthesize
+func (f *FakeDialogflow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/v1/text:synthesize" {
+		f.synthesize(w, r)
+		return
+	}
+	if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/entityTypes") {
+		f.createEntityType(w, r)
+		return
+	}
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v3/") && strings.HasSuffix(r.URL.Path, "/entityTypes") {
+		f.listEntityTypes(w, r)
+		return
+	}
+	if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, ":detectIntent") {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v2/"):
+		f.detectIntentV2(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), ":detectIntent"))
+	case strings.HasPrefix(r.URL.Path, "/v3/"):
+		f.detectIntentV3(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v3/"), ":detectIntent"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *FakeDialogflow) detectIntentV2(w http.ResponseWriter, r *http.Request, session string) {
+	var req struct {
+		QueryInput struct {
+			Text struct {
+				Text         string `json:"text"`
+				LanguageCode string `json:"languageCode"`
+			} `json:"text"`
+			AudioConfig struct {
+				LanguageCode string `json:"languageCode"`
+			} `json:"audioConfig"`
+			Event struct {
+				Name         string `json:"name"`
+				LanguageCode string `json:"languageCode"`
+			} `json:"event"`
+		} `json:"queryInput"`
+		QueryParams struct {
+			Contexts []struct {
+				Name string `json:"name"`
+			} `json:"contexts"`
+			ResetContexts bool `json:"resetContexts"`
+		} `json:"queryParams"`
+		InputAudio []byte `json:"inputAudio"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text, lang := req.QueryInput.Text.Text, req.QueryInput.Text.LanguageCode
+	if req.InputAudio != nil {
+		text, lang = string(req.InputAudio), req.QueryInput.AudioConfig.LanguageCode
+	}
+	if req.QueryInput.Event.Name != "" {
+		lang = req.QueryInput.Event.LanguageCode
+	}
+	var names []string
+	for _, c := range req.QueryParams.Contexts {
+		names = append(names, c.Name)
+	}
+	f.ApplyContexts(session, names, req.QueryParams.ResetContexts)
+
+	res, _ := f.Match(session, text, req.QueryInput.Event.Name)
+	var contexts []map[string]interface{}
+	for _, c := range f.Contexts(session) {
+		contexts = append(contexts, map[string]interface{}{
+			"name":          session + "/contexts/" + c,
+			"lifespanCount": 5,
+		})
+	}
+	resp := map[string]interface{}{
+		"responseId": "fake",
+		"queryResult": map[string]interface{}{
+			"queryText":                res.QueryText,
+			"languageCode":             lang,
+			"parameters":               res.Parameters,
+			"allRequiredParamsPresent": true,
+			"fulfillmentText":          res.FulfillmentText,
+			"fulfillmentMessages": []interface{}{
+				map[string]interface{}{"text": map[string]interface{}{"text": []string{res.FulfillmentText}}},
+			},
+			"outputContexts":            contexts,
+			"intent":                    map[string]interface{}{"displayName": res.Intent},
+			"intentDetectionConfidence": res.Confidence,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *FakeDialogflow) detectIntentV3(w http.ResponseWriter, r *http.Request, session string) {
+	var req struct {
+		QueryInput struct {
+			Text struct {
+				Text string `json:"text"`
+			} `json:"text"`
+			Audio struct {
+				Audio []byte `json:"audio"`
+			} `json:"audio"`
+			Event struct {
+				Event string `json:"event"`
+			} `json:"event"`
+			LanguageCode string `json:"languageCode"`
+		} `json:"queryInput"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text := req.QueryInput.Text.Text
+	if req.QueryInput.Audio.Audio != nil {
+		text = string(req.QueryInput.Audio.Audio)
+	}
+
+	res, turn := f.Match(session, text, req.QueryInput.Event.Event)
+	queryResult := map[string]interface{}{
+		"languageCode": req.QueryInput.LanguageCode,
+		"parameters":   res.Parameters,
+		"responseMessages": []interface{}{
+			map[string]interface{}{"text": map[string]interface{}{"text": []string{res.FulfillmentText}}},
+		},
+		"currentPage":               map[string]interface{}{"displayName": turn.Page},
+		"intent":                    map[string]interface{}{"displayName": res.Intent},
+		"intentDetectionConfidence": res.Confidence,
+		"match": map[string]interface{}{
+			"intent":     map[string]interface{}{"displayName": res.Intent},
+			"confidence": res.Confidence,
+		},
+	}
+	if req.QueryInput.Event.Event != "" {
+		queryResult["triggerEvent"] = req.QueryInput.Event.Event
+	} else if req.QueryInput.Audio.Audio != nil {
+		queryResult["transcript"] = res.QueryText
+	} else {
+		queryResult["text"] = res.QueryText
+	}
+	resp := map[string]interface{}{"responseId": "fake", "queryResult": queryResult}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+//createEntityType implements POST /v2/{session}/entityTypes and its v3 twin,
+//which names the type by its id
+func (f *FakeDialogflow) createEntityType(w http.ResponseWriter, r *http.Request) {
+	session := strings.TrimSuffix(r.URL.Path[len("/v2/"):], "/entityTypes")
+	var req struct {
+		Name     string   `json:"name"`
+		Entities []Entity `json:"entities"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := req.Name[strings.LastIndex(req.Name, "/")+1:]
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		display, ok := f.entityTypes[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("entity type %s not found", name), http.StatusNotFound)
+			return
+		}
+		name = display
+	}
+	f.SetEntities(session, name, req.Entities)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(req)
+}
+
+//listEntityTypes implements the CX GET /v3/{agent}/entityTypes, in one page
+func (f *FakeDialogflow) listEntityTypes(w http.ResponseWriter, r *http.Request) {
+	agent := strings.TrimSuffix(r.URL.Path[len("/v3/"):], "/entityTypes")
+	var types []map[string]string
+	for id, display := range f.entityTypes {
+		types = append(types, map[string]string{"name": agent + "/entityTypes/" + id, "displayName": display})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entityTypes": types})
+}
+
+//synthesize returns the text itself as the "audio"
+func (f *FakeDialogflow) synthesize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input struct {
+			Text string `json:"text"`
+		} `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"audioContent": []byte(req.Input.Text)})
+}
+
+//DetectIntent implements the gRPC Sessions service
+func (f *FakeDialogflow) DetectIntent(ctx context.Context, req *dialogflowpb.DetectIntentRequest) (*dialogflowpb.DetectIntentResponse, error) {
+	text, lang := req.GetQueryInput().GetText().GetText(), req.GetQueryInput().GetText().GetLanguageCode()
+	if req.GetInputAudio() != nil {
+		text, lang = string(req.GetInputAudio()), req.GetQueryInput().GetAudioConfig().GetLanguageCode()
+	}
+	event := req.GetQueryInput().GetEvent()
+	if event != nil {
+		lang = event.GetLanguageCode()
+	}
+	f.applyPbContexts(req.GetSession(), req.GetQueryParams())
+	res, _ := f.Match(req.GetSession(), text, event.GetName())
+	var contexts []*dialogflowpb.Context
+	for _, c := range f.Contexts(req.GetSession()) {
+		contexts = append(contexts, &dialogflowpb.Context{
+			Name:          req.GetSession() + "/contexts/" + c,
+			LifespanCount: 5,
+		})
+	}
+	return &dialogflowpb.DetectIntentResponse{
+		ResponseId: "fake",
+		QueryResult: &dialogflowpb.QueryResult{
+			QueryText:                 res.QueryText,
+			LanguageCode:              lang,
+			Parameters:                mapToStruct(res.Parameters),
+			AllRequiredParamsPresent:  true,
+			FulfillmentText:           res.FulfillmentText,
+			FulfillmentMessages:       fakeMessages(res.FulfillmentText),
+			OutputContexts:            contexts,
+			Intent:                    &dialogflowpb.Intent{DisplayName: res.Intent},
+			IntentDetectionConfidence: float32(res.Confidence),
+		},
+	}, nil
+}
+
+func fakeMessages(text string) []*dialogflowpb.Intent_Message {
+	return []*dialogflowpb.Intent_Message{{
+		Message: &dialogflowpb.Intent_Message_Text_{Text: &dialogflowpb.Intent_Message_Text{Text: []string{text}}},
+	}}
+}
+
+func (f *FakeDialogflow) applyPbContexts(session string, qp *dialogflowpb.QueryParameters) {
+	var names []string
+	for _, c := range qp.GetContexts() {
+		names = append(names, c.GetName())
+	}
+	f.ApplyContexts(session, names, qp.GetResetContexts())
+}
+
+//StreamingDetectIntent implements the gRPC streaming call, reporting the
+//audio received so far as an interim transcript after every chunk
+func (f *FakeDialogflow) StreamingDetectIntent(stream dialogflowpb.Sessions_StreamingDetectIntentServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	session, lang := first.GetSession(), first.GetQueryInput().GetAudioConfig().GetLanguageCode()
+	f.applyPbContexts(session, first.GetQueryParams())
+
+	var transcript []byte
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		transcript = append(transcript, req.GetInputAudio()...)
+		err = stream.Send(&dialogflowpb.StreamingDetectIntentResponse{
+			RecognitionResult: &dialogflowpb.StreamingRecognitionResult{
+				MessageType: dialogflowpb.StreamingRecognitionResult_TRANSCRIPT,
+				Transcript:  string(transcript),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = stream.Send(&dialogflowpb.StreamingDetectIntentResponse{
+		RecognitionResult: &dialogflowpb.StreamingRecognitionResult{
+			MessageType: dialogflowpb.StreamingRecognitionResult_TRANSCRIPT,
+			Transcript:  string(transcript),
+			IsFinal:     true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	res, _ := f.Match(session, string(transcript), "")
+	return stream.Send(&dialogflowpb.StreamingDetectIntentResponse{
+		ResponseId: "fake",
+		QueryResult: &dialogflowpb.QueryResult{
+			QueryText:                 res.QueryText,
+			LanguageCode:              lang,
+			Parameters:                mapToStruct(res.Parameters),
+			AllRequiredParamsPresent:  true,
+			FulfillmentText:           res.FulfillmentText,
+			FulfillmentMessages:       fakeMessages(res.FulfillmentText),
+			Intent:                    &dialogflowpb.Intent{DisplayName: res.Intent},
+			IntentDetectionConfidence: float32(res.Confidence),
+		},
+	})
+}
+
+//fakeSessionEntityTypes implements the gRPC SessionEntityTypes service
+type fakeSessionEntityTypes struct {
+	dialogflowpb.UnimplementedSessionEntityTypesServer
+	f *FakeDialogflow
+}
+
+func (s *fakeSessionEntityTypes) CreateSessionEntityType(ctx context.Context, req *dialogflowpb.CreateSessionEntityTypeRequest) (*dialogflowpb.SessionEntityType, error) {
+	set := req.GetSessionEntityType()
+	var entities []Entity
+	for _, e := range set.GetEntities() {
+		entities = append(entities, Entity{Value: e.GetValue(), Synonyms: e.GetSynonyms()})
+	}
+	s.f.SetEntities(req.GetParent(), set.GetName()[strings.LastIndex(set.GetName(), "/")+1:], entities)
+	return set, nil
+}
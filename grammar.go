@@ -0,0 +1,159 @@
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//Grammar is a local keyword/regexp recognizer used when Dialogflow cannot
+//be reached. Rules are tried in file order and the first match wins.
+type Grammar struct {
+	Rules   []*GrammarRule `json:"rules"`
+	Default GrammarRule    `json:"default"`
+}
+
+type GrammarRule struct {
+	Intent          string                 `json:"intent"`
+	FulfillmentText string                 `json:"fulfillmentText"`
+	Keywords        []string               `json:"keywords"` // whole words, case insensitive
+	Regex           []string               `json:"regex"`    // case insensitive, "$1" in parameters expands to a group
+	States          []float64              `json:"states"`   // current state codes the rule applies in, empty for any
+	Parameters      map[string]interface{} `json:"parameters"`
+
+	patterns []*regexp.Regexp
+}
+
+func LoadGrammar(path string) (*Grammar, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g Grammar
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	for _, r := range g.Rules {
+		exprs := r.Regex
+		if len(r.Keywords) > 0 {
+			var words []string
+			for _, k := range r.Keywords {
+				words = append(words, regexp.QuoteMeta(k))
+			}
+			exprs = append(exprs, `\b(`+strings.Join(words, "|")+`)\b`)
+		}
+		for _, e := range exprs {
+			re, err := regexp.Compile("(?i)" + e)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: intent %s: %s", path, r.Intent, err))
+			}
+			r.patterns = append(r.patterns, re)
+		}
+	}
+	return &g, nil
+}
+
+//Recognize matches text said in state against the grammar
+func (g *Grammar) Recognize(text string, state float64) *QueryResult {
+	for _, r := range g.Rules {
+		if !r.appliesIn(state) {
+			continue
+		}
+		for _, re := range r.patterns {
+			m := re.FindStringSubmatchIndex(text)
+			if m == nil {
+				continue
+			}
+			return r.result(text, func(s string) string {
+				return string(re.ExpandString(nil, s, text, m))
+			})
+		}
+	}
+	return g.Default.result(text, func(s string) string { return s })
+}
+
+func (r *GrammarRule) appliesIn(state float64) bool {
+	if len(r.States) == 0 {
+		return true
+	}
+	for _, s := range r.States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *GrammarRule) result(text string, expand func(string) string) *QueryResult {
+	params := make(map[string]interface{})
+	for k, v := range r.Parameters {
+		params[k] = expandValue(v, expand)
+	}
+	return &QueryResult{
+		QueryText:       text,
+		Intent:          r.Intent,
+		FulfillmentText: r.FulfillmentText,
+		Parameters:      params,
+	}
+}
+
+//FallbackNLU answers from the local grammar when the primary provider fails
+//or does not answer within Timeout
+type FallbackNLU struct {
+	Primary NLU
+	Grammar *Grammar
+	Timeout time.Duration
+}
+
+func (n *FallbackNLU) DetectIntent(ctx context.Context, req *NLURequest) (*QueryResult, error) {
+	pctx := ctx
+	if n.Timeout > 0 {
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithTimeout(ctx, n.Timeout)
+		defer cancel()
+	}
+	res, err := n.Primary.DetectIntent(pctx, req)
+	if err == nil {
+		return res, nil
+	}
+	log.Printf("nlu: %s, falling back to local grammar", err)
+	res = n.Grammar.Recognize(req.Text, req.State)
+	res.Fallback = true
+	return res, nil
+}
+
+//NewFallbackNLU wraps primary with the grammar. The wrapper streams and sets
+//session entity types only when primary can, so asking it for either still
+//tells whether the provider supports it.
+func NewFallbackNLU(primary NLU, g *Grammar, timeout time.Duration) NLU {
+	n := &FallbackNLU{Primary: primary, Grammar: g, Timeout: timeout}
+	s, streams := primary.(StreamingNLU)
+	e, entities := primary.(SessionEntityTyper)
+	switch {
+	case streams && entities:
+		return struct {
+			*FallbackNLU
+			StreamingNLU
+			SessionEntityTyper
+		}{n, s, e}
+	case streams:
+		return struct {
+			*FallbackNLU
+			StreamingNLU
+		}{n, s}
+	case entities:
+		return struct {
+			*FallbackNLU
+			SessionEntityTyper
+		}{n, e}
+	}
+	return n
+}
@@ -0,0 +1,142 @@
+// +build ignore
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//Heartbeat settings of every connection
+type Heartbeat struct {
+	PingInterval time.Duration // between pings
+	PongWait     time.Duration // a peer silent for this long, not even a pong, is gone
+	WriteTimeout time.Duration // for every write, a peer that stops reading is gone
+	IdleTimeout  time.Duration // without a frame from the device before hanging up, 0 never
+	IdleReminder time.Duration // without a frame before the idle_reminder prompt, 0 never
+}
+
+//heartbeat is set from the flags in main
+var heartbeat Heartbeat
+
+//touch records a frame from the device, and gives it another PongWait to
+//send the next one or answer a ping
+func (c *Conn) touch() {
+	c.mu.Lock()
+	c.lastFrame = time.Now()
+	c.mu.Unlock()
+	c.SetReadDeadline(time.Now().Add(heartbeat.PongWait))
+}
+
+//name identifies the connection in the log, by its device or, before an
+//anonymous connection's first frame, its address
+func (c *Conn) name() string {
+	if d := c.Device(); d != "" {
+		return d
+	}
+	return c.RemoteAddr().String()
+}
+
+func (c *Conn) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastFrame)
+}
+
+//hangUp closes the connection from the server's side, telling the device
+//why when message is not empty. The echo loop logs reason once its read
+//fails.
+func (c *Conn) hangUp(reason, message string) {
+	c.mu.Lock()
+	c.hungUp = reason
+	c.mu.Unlock()
+	if message != "" {
+		c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, message),
+			time.Now().Add(heartbeat.WriteTimeout))
+	}
+	c.Close()
+}
+
+func (c *Conn) hangUpReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hungUp
+}
+
+//OnClose runs f once the connection is gone, whatever the reason
+func (c *Conn) OnClose(f func()) {
+	c.mu.Lock()
+	c.closers = append(c.closers, f)
+	c.mu.Unlock()
+}
+
+//cleanup runs the OnClose functions, last added first, and closes the
+//connection
+func (c *Conn) cleanup() {
+	c.mu.Lock()
+	c.gone, c.closedAt = true, time.Now()
+	closers := c.closers
+	c.closers = nil
+	c.mu.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+	if c.Conn != nil {
+		c.Close()
+	}
+	close(c.finished())
+}
+
+//finished is closed once cleanup has run, after which nothing is written to
+//the connection or kept for a resuming one
+func (c *Conn) finished() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cleaned == nil {
+		c.cleaned = make(chan struct{})
+	}
+	return c.cleaned
+}
+
+//keepAlive pings c until done is closed, and hangs up when the device has
+//been idle for IdleTimeout. A peer that does not answer makes the echo loop's
+//read fail once its deadline passes; the echo loop installs the pong handler
+//extending it, as handlers belong to the reading goroutine.
+func (c *Conn) keepAlive(done <-chan struct{}) {
+	ping := time.NewTicker(heartbeat.PingInterval)
+	defer ping.Stop()
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	reminded := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeat.WriteTimeout))
+			if err != nil {
+				c.hangUp(fmt.Sprintf("ping: %s", err), "")
+				return
+			}
+		case <-check.C:
+			idle := c.idle()
+			if heartbeat.IdleTimeout > 0 && idle >= heartbeat.IdleTimeout {
+				c.hangUp(fmt.Sprintf("idle for %s", idle.Round(time.Second)), "idle timeout")
+				return
+			}
+			if idle < heartbeat.IdleReminder {
+				reminded = false
+			} else if heartbeat.IdleReminder > 0 && !reminded && c.Device() != "" {
+				reminded = true
+				h, _ := conns.State(c.Device())
+				if err := c.pushOutput(c.Device(), "idle_reminder", h[3], nil); err != nil {
+					log.Println("idle:", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// +build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+//maxTurnBody is the largest Message POSTed to /turn, audio included
+const maxTurnBody = 1 << 20
+
+//httpProtocol is the protocol query parameter of an HTTP request, one of
+//the WebSocket subprotocols or empty for the legacy arrays
+func httpProtocol(r *http.Request) (string, bool) {
+	switch p := r.URL.Query().Get("protocol"); p {
+	case "", ProtocolV2, ProtocolV2Proto:
+		return p, true
+	default:
+		return p, false
+	}
+}
+
+//turnHandler answers one Message POSTed to /turn with the frame a
+//WebSocket would have been sent, through the same pipeline. The device's
+//session is its current one, as if every request came on one long
+//connection:
+//
+//	curl -d '{"header":[1111,0,0,0,3,0],"data":{"query":"burrito"}}' localhost:8080/turn
+//
+//Binary frames, legacy audio or chipotle.v2.proto, are POSTed as
+//application/octet-stream.
+func turnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device, _, err := deviceAuth.Authenticate(r)
+	if err != nil {
+		log.Printf("auth: %s: %s", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	protocol, ok := httpProtocol(r)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown protocol %q", protocol), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTurnBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mt := websocket.TextMessage
+	if protocol == ProtocolV2Proto || r.Header.Get("Content-Type") == "application/octet-stream" {
+		mt = websocket.BinaryMessage
+	}
+
+	var frames []Frame
+	c := &Conn{protocol: protocol, lang: messages.NegotiateLang(r.Header.Get("Accept-Language"), *defaultLang),
+		turnOnly: true}
+	c.send = func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	}
+	if device != nil {
+		if device.Lang != "" {
+			c.lang = device.Lang
+		}
+		c.setDevice(device.ID)
+	}
+	defer c.cleanup()
+	if !handleFrame(r.Context(), c, mt, body) {
+		http.Error(w, c.refused, http.StatusForbidden)
+		return
+	}
+	if len(frames) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	//a reply with talkback audio is followed by its audio frame, HTTP
+	//callers cannot ask for talkback so it is only there in a replayed reply
+	f := frames[0]
+	if f.Type == websocket.BinaryMessage {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(errorStatus(frameError(f)))
+	w.Write(f.Data)
+}
+
+//frameError returns the error an error frame carries, nil for any other
+//frame
+func frameError(f Frame) *FrameError {
+	if f.Type == websocket.BinaryMessage {
+		var pb OutputPb
+		if err := proto.Unmarshal(f.Data, &pb); err != nil || pb.Error == nil {
+			return nil
+		}
+		return &FrameError{Code: pb.Error.Code}
+	}
+	var out ErrorOutput
+	json.Unmarshal(f.Data, &out)
+	return out.Error
+}
+
+//errorStatus is the HTTP status of a response carrying e
+func errorStatus(e *FrameError) int {
+	if e == nil {
+		return http.StatusOK
+	}
+	switch e.Code {
+	case ErrNLU:
+		return http.StatusBadGateway
+	case ErrInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+//eventsHandler streams the Outputs pushed to a device as Server-Sent
+//Events, one JSON frame per event, for clients that take their turns over
+///turn:
+//
+//	curl -N localhost:8080/events?device=1111
+//
+//An authenticated device needs no device parameter. Like a WebSocket the
+//stream becomes the device's connection for pushes.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	device, _, err := deviceAuth.Authenticate(r)
+	if err != nil {
+		log.Printf("auth: %s: %s", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	protocol, ok := httpProtocol(r)
+	if !ok || protocol == ProtocolV2Proto {
+		http.Error(w, fmt.Sprintf("unsupported protocol %q", protocol), http.StatusBadRequest)
+		return
+	}
+	id := r.URL.Query().Get("device")
+	if device == nil {
+		d, err := deviceAuth.Registry.Lookup(id)
+		if err != nil {
+			log.Println("auth:", err)
+			http.Error(w, "device is not registered", http.StatusForbidden)
+			return
+		}
+		device = &d
+	} else if id != "" && id != device.ID {
+		http.Error(w, "device id does not match the device credential", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := &Conn{protocol: protocol, lang: messages.NegotiateLang(r.Header.Get("Accept-Language"), *defaultLang)}
+	c.send = func(f Frame) error {
+		if f.Type != websocket.TextMessage {
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", f.Data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if device.Lang != "" {
+		c.lang = device.Lang
+	}
+	c.setDevice(device.ID)
+	defer c.cleanup()
+	log.Printf("events: %s: streaming", device.ID)
+
+	//comments keep proxies from timing the stream out
+	ping := time.NewTicker(heartbeat.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("events: %s: closed", device.ID)
+			return
+		case <-ping.C:
+			c.mu.Lock()
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			c.mu.Unlock()
+			if err != nil {
+				log.Printf("events: %s: %s", device.ID, err)
+				return
+			}
+		}
+	}
+}
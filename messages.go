@@ -0,0 +1,87 @@
+// +build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+//Catalog holds the talkback prompts of every language, keyed by language
+//tag then message key. It is loaded from one <lang>.json file per language.
+type Catalog map[string]map[string]string
+
+const fallbackLang = "en"
+
+func LoadCatalog(dir string) (Catalog, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	c := make(Catalog)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", f, err))
+		}
+		c[strings.ToLower(strings.TrimSuffix(filepath.Base(f), ".json"))] = m
+	}
+	if _, ok := c[fallbackLang]; !ok {
+		return nil, errors.New(fmt.Sprintf("%s: no %s catalog", dir, fallbackLang))
+	}
+	return c, nil
+}
+
+//Text returns the prompt key in lang, trying the base language ("es" for
+//"es-MX") and then English
+func (c Catalog) Text(lang, key string) string {
+	lang = strings.ToLower(lang)
+	for _, l := range []string{lang, baseLang(lang), fallbackLang} {
+		if t, ok := c[l][key]; ok {
+			return t
+		}
+	}
+	return key
+}
+
+//Has reports whether key is a prompt. Every prompt is in the fallback
+//language, which the others fall back to.
+func (c Catalog) Has(key string) bool {
+	_, ok := c[fallbackLang][key]
+	return ok
+}
+
+//Supports reports whether lang or its base language has a catalog
+func (c Catalog) Supports(lang string) bool {
+	lang = strings.ToLower(lang)
+	_, ok := c[lang]
+	_, base := c[baseLang(lang)]
+	return ok || base
+}
+
+func baseLang(lang string) string {
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		return lang[:i]
+	}
+	return lang
+}
+
+//NegotiateLang picks the first supported language of an Accept-Language
+//header, or def
+func (c Catalog) NegotiateLang(acceptLanguage, def string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if tag != "" && tag != "*" && c.Supports(tag) {
+			return tag
+		}
+	}
+	return def
+}
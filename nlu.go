@@ -0,0 +1,185 @@
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//NLU detects the intent of a user turn within a Dialogflow session
+type NLU interface {
+	DetectIntent(ctx context.Context, req *NLURequest) (*QueryResult, error)
+}
+
+//StreamingNLU is implemented by providers that recognize audio while it is
+//still being recorded
+type StreamingNLU interface {
+	StreamDetectIntent(ctx context.Context, req *NLURequest) (AudioStream, error)
+}
+
+//AudioStream relays audio chunks to the provider. Recv returns interim
+//transcripts and finally a StreamResult carrying the QueryResult, then io.EOF.
+type AudioStream interface {
+	Send(chunk []byte) error
+	CloseSend() error
+	Recv() (*StreamResult, error)
+}
+
+type StreamResult struct {
+	Transcript string
+	Final      bool         // the transcript will not change any more
+	Result     *QueryResult // set once the intent is detected
+}
+
+//NLURequest is a single user turn sent to the NLU provider
+type NLURequest struct {
+	SessionID    string
+	Text         string
+	LanguageCode string
+	State        float64 // current device state, used by the local grammar
+
+	Audio         []byte // when set the turn is recognized from audio instead of Text
+	AudioEncoding string // "LINEAR16" or "OGG_OPUS"
+	SampleRate    int32
+
+	Params *QueryParams
+
+	Event *Event // when set the turn triggers an event instead of matching Text
+}
+
+//Event is a Dialogflow event query input, e.g. ACTION_TRUE
+type Event struct {
+	Name       string
+	Parameters map[string]interface{}
+}
+
+//QueryParams are forwarded to Dialogflow as queryParams. The json names
+//match the REST API.
+type QueryParams struct {
+	Contexts      []QueryContext         `json:"contexts,omitempty"`
+	Payload       map[string]interface{} `json:"payload,omitempty"`
+	TimeZone      string                 `json:"timeZone,omitempty"`
+	GeoLocation   *GeoLocation           `json:"geoLocation,omitempty"`
+	ResetContexts bool                   `json:"resetContexts,omitempty"`
+}
+
+//QueryContext is an input context. Name may be the short context name, it
+//is expanded to the full session path before it is sent.
+type QueryContext struct {
+	Name          string                 `json:"name"`
+	LifespanCount int32                  `json:"lifespanCount,omitempty"`
+	Parameters    map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type GeoLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+//WithDefaults fills the time zone and location from def when the device did
+//not send them
+func (p *QueryParams) WithDefaults(def *QueryParams) *QueryParams {
+	if p == nil {
+		return def
+	}
+	if def == nil {
+		return p
+	}
+	q := *p
+	if q.TimeZone == "" {
+		q.TimeZone = def.TimeZone
+	}
+	if q.GeoLocation == nil {
+		q.GeoLocation = def.GeoLocation
+	}
+	return &q
+}
+
+//ForSession returns a copy of p with context names expanded under sessionPath
+func (p *QueryParams) ForSession(sessionPath string) *QueryParams {
+	if p == nil {
+		return nil
+	}
+	q := *p
+	q.Contexts = make([]QueryContext, len(p.Contexts))
+	for i, c := range p.Contexts {
+		if !strings.Contains(c.Name, "/") {
+			c.Name = sessionPath + "/contexts/" + c.Name
+		}
+		q.Contexts[i] = c
+	}
+	return &q
+}
+
+//QueryResult is the provider independent result of a detect intent call.
+//It is sent to verbose connections as the nlu block of the Output.
+type QueryResult struct {
+	QueryText                string                   `json:"queryText"`
+	Intent                   string                   `json:"intent"`
+	FulfillmentText          string                   `json:"fulfillmentText"`
+	FulfillmentMessages      []map[string]interface{} `json:"fulfillmentMessages"`
+	Parameters               map[string]interface{}   `json:"parameters"`
+	Confidence               float64                  `json:"intentDetectionConfidence"`
+	OutputContexts           []QueryContext           `json:"outputContexts"`
+	AllRequiredParamsPresent bool                     `json:"allRequiredParamsPresent"`
+	Fallback                 bool                     `json:"fallback"` // answered by the local grammar, not Dialogflow
+}
+
+//audioEncodings maps the encodings devices send onto Dialogflow's enum names
+var audioEncodings = map[string]string{
+	"LINEAR16": "AUDIO_ENCODING_LINEAR_16",
+	"OGG_OPUS": "AUDIO_ENCODING_OGG_OPUS",
+}
+
+func audioEncoding(name string) (string, error) {
+	e, ok := audioEncodings[name]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Unsupported audio encoding %q", name))
+	}
+	return e, nil
+}
+
+//NLUConfig selects and configures the NLU provider at startup
+type NLUConfig struct {
+	Kind      string // "rest", "grpc" or "cx"
+	ProjectID string
+	BaseURL   string // REST base url, empty for the provider's default
+	Endpoint  string // gRPC endpoint, empty for the default
+	Insecure  bool   // plaintext and no credentials, used against the fake server
+
+	Credentials *Credentials // required unless Insecure
+
+	Location string  // CX agent location
+	AgentID  string  // CX agent id
+	Pages    CxPages // CX page to v2 intent mapping
+}
+
+//NewNLU returns the provider selected by cfg.Kind
+func NewNLU(cfg NLUConfig) (NLU, error) {
+	if cfg.ProjectID == "" {
+		return nil, errors.New("Received empty project")
+	}
+	var token func() (string, error)
+	if !cfg.Insecure {
+		if cfg.Credentials == nil {
+			return nil, errors.New("Received no credentials")
+		}
+		token = cfg.Credentials.AccessToken
+	}
+	switch cfg.Kind {
+	case "rest":
+		n := NewRestNLU(cfg.ProjectID, cfg.BaseURL)
+		n.Token = token
+		return n, nil
+	case "grpc":
+		return NewGrpcNLU(context.Background(), cfg.ProjectID, cfg.Endpoint, cfg.Insecure, cfg.Credentials)
+	case "cx":
+		n := NewCxNLU(cfg.ProjectID, cfg.Location, cfg.AgentID, cfg.BaseURL, cfg.Pages)
+		n.Token = token
+		return n, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown nlu provider %q", cfg.Kind))
+}
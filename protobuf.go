@@ -0,0 +1,264 @@
+// +build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+//ProtocolV2Proto is chipotle.v2 with every frame a binary WebSocket message
+//encoded as in proto/chipotle.proto
+const ProtocolV2Proto = "chipotle.v2.proto"
+
+//The types below mirror proto/chipotle.proto field for field; keep the two
+//in sync.
+
+type HeaderPb struct {
+	Version      int32   `protobuf:"varint,1,opt,name=version,proto3"`
+	DeviceId     string  `protobuf:"bytes,2,opt,name=device_id,json=deviceId,proto3"`
+	Mode         float64 `protobuf:"fixed64,3,opt,name=mode,proto3"`
+	CurrentState float64 `protobuf:"fixed64,4,opt,name=current_state,json=currentState,proto3"`
+	NextState    float64 `protobuf:"fixed64,5,opt,name=next_state,json=nextState,proto3"`
+	Timestamp    int64   `protobuf:"varint,6,opt,name=timestamp,proto3"`
+}
+
+func (m *HeaderPb) Reset()         { *m = HeaderPb{} }
+func (m *HeaderPb) String() string { return proto.CompactTextString(m) }
+func (*HeaderPb) ProtoMessage()    {}
+
+type MessagePb struct {
+	Header *HeaderPb `protobuf:"bytes,1,opt,name=header,proto3"`
+	Data   *DataPb   `protobuf:"bytes,2,opt,name=data,proto3"`
+	Id     string    `protobuf:"bytes,3,opt,name=id,proto3"`
+}
+
+func (m *MessagePb) Reset()         { *m = MessagePb{} }
+func (m *MessagePb) String() string { return proto.CompactTextString(m) }
+func (*MessagePb) ProtoMessage()    {}
+
+type DataPb struct {
+	Query      string         `protobuf:"bytes,1,opt,name=query,proto3"`
+	Result     string         `protobuf:"bytes,2,opt,name=result,proto3"`
+	Stream     string         `protobuf:"bytes,3,opt,name=stream,proto3"`
+	Encoding   string         `protobuf:"bytes,4,opt,name=encoding,proto3"`
+	SampleRate int32          `protobuf:"varint,5,opt,name=sample_rate,json=sampleRate,proto3"`
+	Config     *ConfigPb      `protobuf:"bytes,6,opt,name=config,proto3"`
+	Session    string         `protobuf:"bytes,7,opt,name=session,proto3"`
+	Params     *QueryParamsPb `protobuf:"bytes,8,opt,name=params,proto3"`
+	Lang       string         `protobuf:"bytes,9,opt,name=lang,proto3"`
+	Audio      []byte         `protobuf:"bytes,10,opt,name=audio,proto3"`
+	Info       string         `protobuf:"bytes,11,opt,name=info,proto3"`
+}
+
+func (m *DataPb) Reset()         { *m = DataPb{} }
+func (m *DataPb) String() string { return proto.CompactTextString(m) }
+func (*DataPb) ProtoMessage()    {}
+
+type ConfigPb struct {
+	OutputAudio *OutputAudioConfigPb `protobuf:"bytes,1,opt,name=output_audio,json=outputAudio,proto3"`
+	Verbose     bool                 `protobuf:"varint,2,opt,name=verbose,proto3"`
+}
+
+func (m *ConfigPb) Reset()         { *m = ConfigPb{} }
+func (m *ConfigPb) String() string { return proto.CompactTextString(m) }
+func (*ConfigPb) ProtoMessage()    {}
+
+type OutputAudioConfigPb struct {
+	Encoding     string  `protobuf:"bytes,1,opt,name=encoding,proto3"`
+	Voice        string  `protobuf:"bytes,2,opt,name=voice,proto3"`
+	SpeakingRate float64 `protobuf:"fixed64,3,opt,name=speaking_rate,json=speakingRate,proto3"`
+}
+
+func (m *OutputAudioConfigPb) Reset()         { *m = OutputAudioConfigPb{} }
+func (m *OutputAudioConfigPb) String() string { return proto.CompactTextString(m) }
+func (*OutputAudioConfigPb) ProtoMessage()    {}
+
+type QueryParamsPb struct {
+	Contexts      []*ContextPb     `protobuf:"bytes,1,rep,name=contexts,proto3"`
+	Payload       *structpb.Struct `protobuf:"bytes,2,opt,name=payload,proto3"`
+	TimeZone      string           `protobuf:"bytes,3,opt,name=time_zone,json=timeZone,proto3"`
+	GeoLocation   *latlng.LatLng   `protobuf:"bytes,4,opt,name=geo_location,json=geoLocation,proto3"`
+	ResetContexts bool             `protobuf:"varint,5,opt,name=reset_contexts,json=resetContexts,proto3"`
+}
+
+func (m *QueryParamsPb) Reset()         { *m = QueryParamsPb{} }
+func (m *QueryParamsPb) String() string { return proto.CompactTextString(m) }
+func (*QueryParamsPb) ProtoMessage()    {}
+
+type ContextPb struct {
+	Name          string           `protobuf:"bytes,1,opt,name=name,proto3"`
+	LifespanCount int32            `protobuf:"varint,2,opt,name=lifespan_count,json=lifespanCount,proto3"`
+	Parameters    *structpb.Struct `protobuf:"bytes,3,opt,name=parameters,proto3"`
+}
+
+func (m *ContextPb) Reset()         { *m = ContextPb{} }
+func (m *ContextPb) String() string { return proto.CompactTextString(m) }
+func (*ContextPb) ProtoMessage()    {}
+
+type OutputPb struct {
+	Header *HeaderPb     `protobuf:"bytes,1,opt,name=header,proto3"`
+	Data   *OutputDataPb `protobuf:"bytes,2,opt,name=data,proto3"`
+	Error  *ErrorPb      `protobuf:"bytes,3,opt,name=error,proto3"`
+	Id     string        `protobuf:"bytes,4,opt,name=id,proto3"`
+}
+
+func (m *OutputPb) Reset()         { *m = OutputPb{} }
+func (m *OutputPb) String() string { return proto.CompactTextString(m) }
+func (*OutputPb) ProtoMessage()    {}
+
+type OutputDataPb struct {
+	Query      string           `protobuf:"bytes,1,opt,name=query,proto3"`
+	Speech     string           `protobuf:"bytes,2,opt,name=speech,proto3"`
+	Entity     *structpb.Struct `protobuf:"bytes,3,opt,name=entity,proto3"`
+	Fallback   bool             `protobuf:"varint,4,opt,name=fallback,proto3"`
+	Audio      *AudioRefPb      `protobuf:"bytes,5,opt,name=audio,proto3"`
+	Session    string           `protobuf:"bytes,6,opt,name=session,proto3"`
+	Nlu        *structpb.Struct `protobuf:"bytes,7,opt,name=nlu,proto3"`
+	Transcript string           `protobuf:"bytes,8,opt,name=transcript,proto3"`
+	Final      bool             `protobuf:"varint,9,opt,name=final,proto3"`
+	Push       string           `protobuf:"bytes,10,opt,name=push,proto3"`
+	Resume     string           `protobuf:"bytes,11,opt,name=resume,proto3"`
+}
+
+func (m *OutputDataPb) Reset()         { *m = OutputDataPb{} }
+func (m *OutputDataPb) String() string { return proto.CompactTextString(m) }
+func (*OutputDataPb) ProtoMessage()    {}
+
+type AudioRefPb struct {
+	Id       int32  `protobuf:"varint,1,opt,name=id,proto3"`
+	Encoding string `protobuf:"bytes,2,opt,name=encoding,proto3"`
+	Audio    []byte `protobuf:"bytes,3,opt,name=audio,proto3"`
+}
+
+func (m *AudioRefPb) Reset()         { *m = AudioRefPb{} }
+func (m *AudioRefPb) String() string { return proto.CompactTextString(m) }
+func (*AudioRefPb) ProtoMessage()    {}
+
+type ErrorPb struct {
+	Code    string `protobuf:"bytes,1,opt,name=code,proto3"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3"`
+	Field   string `protobuf:"bytes,3,opt,name=field,proto3"`
+	Id      string `protobuf:"bytes,4,opt,name=id,proto3"`
+}
+
+func (m *ErrorPb) Reset()         { *m = ErrorPb{} }
+func (m *ErrorPb) String() string { return proto.CompactTextString(m) }
+func (*ErrorPb) ProtoMessage()    {}
+
+//decodeProtoFrame decodes a chipotle.v2.proto frame into m, the header as
+//its JSON form so it is parsed and validated like any v2 header, and returns
+//the audio it carries
+func decodeProtoFrame(frame []byte, m *Message) ([]byte, *FrameError) {
+	var pb MessagePb
+	if err := proto.Unmarshal(frame, &pb); err != nil {
+		return nil, &FrameError{Code: ErrMalformed, Message: err.Error()}
+	}
+	m.ID = pb.Id
+	if h := pb.Header; h != nil {
+		m.Header, _ = json.Marshal(HeaderV2{
+			Version:      int(h.Version),
+			DeviceID:     h.DeviceId,
+			Mode:         h.Mode,
+			CurrentState: h.CurrentState,
+			NextState:    h.NextState,
+			Timestamp:    h.Timestamp,
+		})
+	}
+	d := pb.Data
+	if d == nil {
+		return nil, nil
+	}
+	m.Data = Data{
+		Query:      d.Query,
+		Result:     d.Result,
+		Stream:     d.Stream,
+		Encoding:   d.Encoding,
+		SampleRate: d.SampleRate,
+		Session:    d.Session,
+		Lang:       d.Lang,
+		Info:       d.Info,
+	}
+	if c := d.Config; c != nil {
+		m.Data.Config = &ConnConfig{Verbose: c.Verbose}
+		if a := c.OutputAudio; a != nil {
+			m.Data.Config.OutputAudio = &OutputAudioConfig{Encoding: a.Encoding, Voice: a.Voice, SpeakingRate: a.SpeakingRate}
+		}
+	}
+	if p := d.Params; p != nil {
+		m.Data.Params = &QueryParams{TimeZone: p.TimeZone, ResetContexts: p.ResetContexts}
+		if p.Payload != nil {
+			m.Data.Params.Payload = structToMap(p.Payload)
+		}
+		if g := p.GeoLocation; g != nil {
+			m.Data.Params.GeoLocation = &GeoLocation{Latitude: g.Latitude, Longitude: g.Longitude}
+		}
+		for _, c := range p.Contexts {
+			qc := QueryContext{Name: c.Name, LifespanCount: c.LifespanCount}
+			if c.Parameters != nil {
+				qc.Parameters = structToMap(c.Parameters)
+			}
+			m.Data.Params.Contexts = append(m.Data.Params.Contexts, qc)
+		}
+	}
+	if len(d.Audio) == 0 {
+		return nil, nil
+	}
+	return d.Audio, nil
+}
+
+//encodeProtoFrame encodes an Output, TranscriptOutput or ErrorOutput, with
+//the talkback audio an Output refers to
+func encodeProtoFrame(v interface{}, audio []byte) ([]byte, error) {
+	var pb OutputPb
+	var header interface{}
+	switch o := v.(type) {
+	case *Output:
+		pb.Id, header = o.ID, o.Header
+		d := &OutputDataPb{
+			Query:    o.Data.Query,
+			Speech:   o.Data.Speech,
+			Fallback: o.Data.Fallback,
+			Session:  o.Data.Session,
+			Push:     o.Data.Push,
+			Resume:   o.Data.Resume,
+		}
+		if o.Data.Entity != nil {
+			d.Entity = mapToStruct(o.Data.Entity)
+		}
+		if a := o.Data.Audio; a != nil {
+			d.Audio = &AudioRefPb{Id: int32(a.ID), Encoding: a.Encoding, Audio: audio}
+		}
+		if o.Data.NLU != nil {
+			b, _ := json.Marshal(o.Data.NLU)
+			var nlu map[string]interface{}
+			json.Unmarshal(b, &nlu)
+			d.Nlu = mapToStruct(nlu)
+		}
+		pb.Data = d
+	case *TranscriptOutput:
+		pb.Id, header = o.ID, o.Header
+		pb.Data = &OutputDataPb{Transcript: o.Data.Transcript, Final: o.Data.Final}
+	case *ErrorOutput:
+		pb.Id, header = o.ID, o.Header
+		pb.Error = &ErrorPb{Code: o.Error.Code, Message: o.Error.Message, Field: o.Error.Field, Id: o.Error.ID}
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot encode %T", v))
+	}
+	if h, ok := header.(HeaderV2); ok {
+		pb.Header = &HeaderPb{
+			Version:      int32(h.Version),
+			DeviceId:     h.DeviceID,
+			Mode:         h.Mode,
+			CurrentState: h.CurrentState,
+			NextState:    h.NextState,
+			Timestamp:    h.Timestamp,
+		}
+	}
+	return proto.Marshal(&pb)
+}
@@ -0,0 +1,90 @@
+// +build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+//ProtocolV2 is the WebSocket subprotocol of the named field protocol.
+//Connections that do not negotiate it speak the legacy positional arrays:
+//
+//	in:  [deviceId, mode, currentState, 0, 3, 0]
+//	out: [deviceId, mode, currentState, nextState, timestamp, 3, 0]
+const ProtocolV2 = "chipotle.v2"
+
+//HeaderV2 is the header of every frame on a chipotle.v2 connection
+type HeaderV2 struct {
+	Version      int     `json:"version"`
+	DeviceID     string  `json:"deviceId"`
+	Mode         float64 `json:"mode"`
+	CurrentState float64 `json:"currentState"`
+	NextState    float64 `json:"nextState"` // set on frames from the server
+	Timestamp    int64   `json:"timestamp"` // milliseconds since the epoch the frame was sent at
+}
+
+//negotiateProtocol returns the first of ProtocolV2 and ProtocolV2Proto the
+//client offers
+func negotiateProtocol(r *http.Request) string {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == ProtocolV2 || p == ProtocolV2Proto {
+			return p
+		}
+	}
+	return ""
+}
+
+//parseHeader decodes a frame header in protocol into the legacy slots
+//HeaderProcess works on, and the device id it names
+func parseHeader(protocol string, raw json.RawMessage) ([6]float64, string, *FrameError) {
+	var h [6]float64
+	invalid := func(field, format string, a ...interface{}) *FrameError {
+		return &FrameError{Code: ErrInvalidField, Field: field, Message: fmt.Sprintf(format, a...)}
+	}
+	if protocol == "" {
+		var slots []float64
+		if err := json.Unmarshal(raw, &slots); err != nil {
+			return h, "", invalid("header", "%s", err)
+		}
+		if len(slots) != len(h) {
+			return h, "", invalid("header", "%d slots, want %d", len(slots), len(h))
+		}
+		copy(h[:], slots)
+		return h, deviceID(h[0]), nil
+	}
+	var v2 HeaderV2
+	if err := decodeStrict(raw, &v2); err != nil {
+		e := decodeError(err)
+		if e.Field != "" {
+			e.Field = "header." + e.Field
+		}
+		return h, "", e
+	}
+	if v2.Version != 2 {
+		return h, "", invalid("header.version", "unsupported version %d", v2.Version)
+	}
+	if v2.DeviceID == "" {
+		return h, "", invalid("header.deviceId", "missing")
+	}
+	h[1], h[2] = v2.Mode, v2.CurrentState
+	return h, v2.DeviceID, nil
+}
+
+//formatHeader encodes the legacy output slots for protocol
+func formatHeader(protocol, device string, h [7]float64) interface{} {
+	if protocol == "" {
+		return h
+	}
+	return HeaderV2{
+		Version:      2,
+		DeviceID:     device,
+		Mode:         h[1],
+		CurrentState: h[2],
+		NextState:    h[3],
+		Timestamp:    int64(h[4]),
+	}
+}
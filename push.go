@@ -0,0 +1,208 @@
+// +build ignore
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//States of pushed Outputs. A device shows the event and reports back from
+//the state like from any other.
+const (
+	StateOrderAccepted   = 8000
+	StateOrderReady      = 8100
+	StatePaymentDeclined = 8200
+	StateStoreClosing    = 8300
+)
+
+//pushEvents are the backend events a device can be sent, with the state
+//their Output moves it to. The talkback is the catalog prompt of the same
+//name.
+var pushEvents = map[string]float64{
+	"order_accepted":   StateOrderAccepted,
+	"order_ready":      StateOrderReady,
+	"payment_declined": StatePaymentDeclined,
+	"store_closing":    StateStoreClosing,
+}
+
+//ErrNotConnected is returned by Push when the device has no open connection
+var ErrNotConnected = errors.New("device is not connected")
+
+//PushEvent is a backend event for one device
+type PushEvent struct {
+	Event string                 `json:"event"` // a key of pushEvents
+	Data  map[string]interface{} `json:"data"`  // sent to the device as the Output's entity, e.g. the order id
+}
+
+//ConnRegistry is the open connections of every device, so any part of the
+//server can reach a device, and the device's dialog state whatever transport
+//its turns come over. A device can have several connections, a WebSocket
+//and an event stream say; pushes go to the newest.
+type ConnRegistry struct {
+	mu     sync.Mutex
+	conns  map[string][]*Conn // oldest first
+	states map[string]deviceState
+}
+
+//deviceState is the header of the last Output sent to a device and its
+//partial order
+type deviceState struct {
+	header [7]float64
+	order  map[string]interface{}
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[string][]*Conn), states: make(map[string]deviceState)}
+}
+
+//Register adds c to the connections of device
+func (r *ConnRegistry) Register(device string, c *Conn) {
+	r.mu.Lock()
+	r.conns[device] = append(r.conns[device], c)
+	r.mu.Unlock()
+}
+
+//Unregister forgets c, leaving device's other connections
+func (r *ConnRegistry) Unregister(device string, c *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	open := r.conns[device]
+	for i, o := range open {
+		if o == c {
+			open = append(open[:i:i], open[i+1:]...)
+			break
+		}
+	}
+	if len(open) == 0 {
+		delete(r.conns, device)
+	} else {
+		r.conns[device] = open
+	}
+}
+
+//Lookup returns device's newest connection
+func (r *ConnRegistry) Lookup(device string) (*Conn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	open := r.conns[device]
+	if len(open) == 0 {
+		return nil, false
+	}
+	return open[len(open)-1], true
+}
+
+//State returns the header of the last Output sent to device, over any
+//connection, and its partial order
+func (r *ConnRegistry) State(device string) ([7]float64, map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.states[device]
+	return st.header, st.order
+}
+
+func (r *ConnRegistry) setState(device string, h [7]float64, order map[string]interface{}) {
+	r.mu.Lock()
+	r.states[device] = deviceState{h, order}
+	r.mu.Unlock()
+}
+
+//Push sends ev to device as an Output
+func (r *ConnRegistry) Push(device string, ev PushEvent) error {
+	state, ok := pushEvents[ev.Event]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown event %q", ev.Event))
+	}
+	c, ok := r.Lookup(device)
+	if !ok {
+		//kept for the device's next connection when it can still resume
+		c, ok = resumes.Latest(device)
+	}
+	if !ok {
+		return ErrNotConnected
+	}
+	log.Printf("push: %s %s", device, ev.Event)
+	return c.pushOutput(device, ev.Event, state, ev.Data)
+}
+
+//pushOutput sends device an Output it did not ask for, moving it from the
+//next state of the last Output it was sent, on any connection, to state.
+//The talkback is the catalog prompt named event.
+func (c *Conn) pushOutput(device, event string, state float64, entity map[string]interface{}) error {
+	var p Output
+	h, order := conns.State(device)
+	h[0], _ = strconv.ParseFloat(device, 64)
+	h[2], h[3] = h[3], state
+	h[4] = float64(time.Now().UnixNano() / 1000000)
+	h[5] = 3
+	p.Header = formatHeader(c.protocol, device, h)
+	c.setState(h, order)
+	lang := c.Lang()
+	p.Data.Push = event
+	p.Data.Resume = c.issueToken()
+	p.Data.Speech = messages.Text(lang, event)
+	p.Data.Entity = entity
+	if p.Data.Entity == nil {
+		p.Data.Entity = map[string]interface{}{}
+	}
+	var audio []byte
+	p.Data.Audio, audio = c.talkback(p.Data.Speech, lang)
+	return c.WriteFrame(&p, audio)
+}
+
+//pushHandler lets backend services push events to devices:
+//
+//	POST /push/358165081199845
+//	Authorization: Bearer <push secret>
+//	{"event":"order_ready","data":{"orderId":"A1234"}}
+//
+//It answers 202 once the Output is written and 404 when the device is not
+//connected.
+func pushHandler(conns *ConnRegistry, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, "Bearer ")), secret) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		device := strings.TrimPrefix(r.URL.Path, "/push/")
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ev PushEvent
+		if err := decodeStrict(body, &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := pushEvents[ev.Event]; !ok {
+			http.Error(w, fmt.Sprintf("unknown event %q", ev.Event), http.StatusBadRequest)
+			return
+		}
+		switch err := conns.Push(device, ev); err {
+		case nil:
+			w.WriteHeader(http.StatusAccepted)
+		case ErrNotConnected:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			log.Println("push:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// +build ignore
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Device is a provisioned device. Only a hash of its API key is kept.
+type Device struct {
+	ID          string    `json:"id"` // header[0], e.g. an IMEI
+	Owner       string    `json:"owner"`
+	Firmware    string    `json:"firmware"`
+	Lang        string    `json:"lang"` // empty to negotiate per connection
+	Enabled     bool      `json:"enabled"`
+	KeyHash     string    `json:"keyHash"`
+	Provisioned time.Time `json:"provisioned"`
+}
+
+//Registry is the file backed list of devices allowed to connect. The file
+//is reread whenever it changes, so devices provisioned or revoked by the
+//admin command take effect on their next connection.
+type Registry struct {
+	Path string
+
+	mu      sync.Mutex
+	devices map[string]*Device
+	modTime time.Time
+	size    int64
+}
+
+//OpenRegistry loads path, a missing file is an empty registry
+func OpenRegistry(path string) (*Registry, error) {
+	r := &Registry{Path: path, devices: make(map[string]*Device)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) reloadLocked() error {
+	fi, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		r.devices = make(map[string]*Device)
+		r.modTime, r.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return err
+	}
+	var list []*Device
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", r.Path, err))
+	}
+	devices := make(map[string]*Device)
+	for _, d := range list {
+		devices[d.ID] = d
+	}
+	r.devices, r.modTime, r.size = devices, fi.ModTime(), fi.Size()
+	return nil
+}
+
+//Lookup returns device id if it is provisioned and enabled
+func (r *Registry) Lookup(id string) (Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadLocked(); err != nil {
+		return Device{}, err
+	}
+	d, ok := r.devices[id]
+	if !ok {
+		return Device{}, errors.New(fmt.Sprintf("device %s is not provisioned", id))
+	}
+	if !d.Enabled {
+		return Device{}, errors.New(fmt.Sprintf("device %s is revoked", id))
+	}
+	return *d, nil
+}
+
+//LookupKey returns the enabled device whose API key is key
+func (r *Registry) LookupKey(key string) (Device, error) {
+	r.mu.Lock()
+	h := hashKey(key)
+	id := ""
+	err := r.reloadLocked()
+	for _, d := range r.devices {
+		if d.KeyHash == h {
+			id = d.ID
+		}
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return Device{}, err
+	}
+	if id == "" {
+		return Device{}, errors.New("unknown device key")
+	}
+	return r.Lookup(id)
+}
+
+//List returns every device, revoked ones included, ordered by id
+func (r *Registry) List() ([]Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadLocked(); err != nil {
+		return nil, err
+	}
+	var list []Device
+	for _, d := range r.devices {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+//Provision adds d, or updates and re-enables it when it exists, with a new
+//API key which is returned. The key is not stored and cannot be recovered.
+func (r *Registry) Provision(d Device) (string, error) {
+	if d.ID == "" {
+		return "", errors.New("Received empty device id")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadLocked(); err != nil {
+		return "", err
+	}
+	if old, ok := r.devices[d.ID]; ok {
+		if d.Owner == "" {
+			d.Owner = old.Owner
+		}
+		if d.Firmware == "" {
+			d.Firmware = old.Firmware
+		}
+		if d.Lang == "" {
+			d.Lang = old.Lang
+		}
+	}
+	key := newDeviceKey()
+	d.KeyHash = hashKey(key)
+	d.Enabled = true
+	d.Provisioned = time.Now().UTC()
+	r.devices[d.ID] = &d
+	return key, r.saveLocked()
+}
+
+//Revoke disables device id, its key and tokens stop working
+func (r *Registry) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadLocked(); err != nil {
+		return err
+	}
+	d, ok := r.devices[id]
+	if !ok {
+		return errors.New(fmt.Sprintf("device %s is not provisioned", id))
+	}
+	d.Enabled = false
+	return r.saveLocked()
+}
+
+//saveLocked writes the registry to a temporary file and renames it over
+//Path, so the server never reads a half written file
+func (r *Registry) saveLocked() error {
+	var list []*Device
+	for _, d := range r.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.Path), ".devices")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.Path); err != nil {
+		return err
+	}
+	//the next reload picks up what was just written
+	r.modTime, r.size = time.Time{}, 0
+	return nil
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func newDeviceKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,194 @@
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	sj "github.com/bitly/go-simplejson"
+)
+
+//Dialogflow Query struct
+type Text struct {
+	Text         string `json:"text"`
+	LanguageCode string `json:"languageCode"`
+}
+
+type AudioConfig struct {
+	AudioEncoding   string `json:"audioEncoding"`
+	SampleRateHertz int32  `json:"sampleRateHertz"`
+	LanguageCode    string `json:"languageCode"`
+}
+
+type EventInput struct {
+	Name         string                 `json:"name"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	LanguageCode string                 `json:"languageCode"`
+}
+
+type TextInput struct {
+	TextInput   *Text        `json:"text,omitempty"`
+	AudioConfig *AudioConfig `json:"audioConfig,omitempty"`
+	Event       *EventInput  `json:"event,omitempty"`
+}
+
+type QueryInput struct {
+	QueryInput  TextInput    `json:"queryInput"`
+	QueryParams *QueryParams `json:"queryParams,omitempty"`
+	InputAudio  []byte       `json:"inputAudio,omitempty"`
+}
+
+//RestNLU talks to Dialogflow through the v2 REST :detectIntent endpoint
+type RestNLU struct {
+	ProjectID string
+	BasePath  string
+	Client    *http.Client
+	Token     func() (string, error) // nil sends no Authorization header
+}
+
+func NewRestNLU(projectID, basePath string) *RestNLU {
+	if basePath == "" {
+		basePath = "https://dialogflow.googleapis.com/v2/"
+	}
+	return &RestNLU{
+		ProjectID: projectID,
+		BasePath:  basePath,
+		Client:    &http.Client{},
+	}
+}
+
+func (n *RestNLU) DetectIntent(ctx context.Context, req *NLURequest) (*QueryResult, error) {
+	if req.SessionID == "" {
+		return nil, errors.New(fmt.Sprintf("Received empty project (%s) or session (%s)", n.ProjectID, req.SessionID))
+	}
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", n.ProjectID, req.SessionID)
+
+	var jsonData QueryInput
+	if req.Event != nil {
+		jsonData.QueryInput.Event = &EventInput{Name: req.Event.Name, Parameters: req.Event.Parameters, LanguageCode: req.LanguageCode}
+	} else if req.Audio != nil {
+		encoding, err := audioEncoding(req.AudioEncoding)
+		if err != nil {
+			return nil, err
+		}
+		jsonData.QueryInput.AudioConfig = &AudioConfig{
+			AudioEncoding:   encoding,
+			SampleRateHertz: req.SampleRate,
+			LanguageCode:    req.LanguageCode,
+		}
+		jsonData.InputAudio = req.Audio
+	} else {
+		jsonData.QueryInput.TextInput = &Text{Text: req.Text, LanguageCode: req.LanguageCode}
+	}
+	jsonData.QueryParams = req.Params.ForSession(sessionPath)
+	jsonValue, err := json.Marshal(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	detectIntentUrl := n.BasePath + sessionPath + ":detectIntent"
+	r, err := http.NewRequest("POST", detectIntentUrl, bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+
+	if n.Token != nil {
+		token, err := n.Token()
+		if err != nil {
+			return nil, err
+		}
+		var bearer = "Bearer " + token
+		r.Header.Add("Authorization", bearer)
+	}
+	r.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := n.Client.Do(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("The HTTP request failed with error %s", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("detectIntent returned %s: %s", resp.Status, data))
+	}
+
+	js, err := sj.NewJson(data)
+	if err != nil {
+		return nil, err
+	}
+	qr := js.Get("queryResult")
+	var extra struct {
+		QueryResult struct {
+			FulfillmentMessages []map[string]interface{} `json:"fulfillmentMessages"`
+			OutputContexts      []QueryContext           `json:"outputContexts"`
+		} `json:"queryResult"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, err
+	}
+	return &QueryResult{
+		QueryText:                qr.Get("queryText").MustString(),
+		Intent:                   qr.Get("intent").Get("displayName").MustString(),
+		FulfillmentText:          qr.Get("fulfillmentText").MustString(),
+		FulfillmentMessages:      extra.QueryResult.FulfillmentMessages,
+		Parameters:               qr.Get("parameters").MustMap(),
+		Confidence:               qr.Get("intentDetectionConfidence").MustFloat64(),
+		OutputContexts:           extra.QueryResult.OutputContexts,
+		AllRequiredParamsPresent: qr.Get("allRequiredParamsPresent").MustBool(),
+	}, nil
+}
+
+//SetSessionEntities creates the session's entity types through
+//POST {session}/entityTypes
+func (n *RestNLU) SetSessionEntities(ctx context.Context, sessionID string, types []SessionEntityType) error {
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", n.ProjectID, sessionID)
+	return createSessionEntityTypes(ctx, n.Client, n.Token, n.BasePath, sessionPath, types)
+}
+
+func createSessionEntityTypes(ctx context.Context, client *http.Client, tokenFn func() (string, error),
+	basePath, sessionPath string, types []SessionEntityType) error {
+	for _, t := range types {
+		body := map[string]interface{}{
+			"name":               sessionPath + "/entityTypes/" + t.Name,
+			"entityOverrideMode": "ENTITY_OVERRIDE_MODE_OVERRIDE",
+			"entities":           t.Entities,
+		}
+		jsonValue, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r, err := http.NewRequest("POST", basePath+sessionPath+"/entityTypes", bytes.NewBuffer(jsonValue))
+		if err != nil {
+			return err
+		}
+		r = r.WithContext(ctx)
+		if tokenFn != nil {
+			token, err := tokenFn()
+			if err != nil {
+				return err
+			}
+			r.Header.Add("Authorization", "Bearer "+token)
+		}
+		r.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+		resp, err := client.Do(r)
+		if err != nil {
+			return errors.New(fmt.Sprintf("The HTTP request failed with error %s", err))
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(fmt.Sprintf("entityTypes %s returned %s: %s", t.Name, resp.Status, data))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// +build ignore
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//resumeHeader carries the resume token: the server's upgrade response
+//issues one, a reconnecting device sends the old one back in it or in the
+//resume query parameter
+const resumeHeader = "Chipotle-Resume"
+
+//maxMissed is how many frames a closed connection keeps for the device
+const maxMissed = 64
+
+//ResumeStore keeps every connection by its resume token, and closed ones
+//for Window after they close, so a device that drops mid-order can pick up
+//where it was on its next connection
+type ResumeStore struct {
+	Window time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+func NewResumeStore(window time.Duration) *ResumeStore {
+	return &ResumeStore{Window: window, conns: make(map[string]*Conn)}
+}
+
+//newResumeToken returns 16 random bytes, hex encoded
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//resumeToken is the token r's device sent to resume an older connection
+func resumeToken(r *http.Request) string {
+	if t := r.Header.Get(resumeHeader); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("resume")
+}
+
+//Add keeps c by its resume token
+func (s *ResumeStore) Add(c *Conn) {
+	s.mu.Lock()
+	s.conns[c.resumeToken] = c
+	s.mu.Unlock()
+}
+
+//Latest returns device's most recently closed connection that can still be
+//resumed
+func (s *ResumeStore) Latest(device string) (*Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest *Conn
+	var latestClosed time.Time
+	for _, c := range s.conns {
+		gone, closed := c.closed()
+		if gone && c.Device() == device && time.Since(closed) < s.Window && closed.After(latestClosed) {
+			latest, latestClosed = c, closed
+		}
+	}
+	return latest, latest != nil
+}
+
+//Resume moves the conversation of the connection token was issued to over
+//to c: its device, state, partial order, language, settings and Dialogflow
+//session, and the frames it could not deliver. The old connection, when it
+//is still open, is hung up and waited for. A token can only be used once.
+func (s *ResumeStore) Resume(c *Conn, token string) error {
+	s.mu.Lock()
+	old, ok := s.conns[token]
+	if ok {
+		delete(s.conns, token)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errors.New("unknown resume token")
+	}
+	gone, closed := old.closed()
+	if gone && time.Since(closed) >= s.Window {
+		return errors.New(fmt.Sprintf("connection of %s closed %s ago", old.Device(), time.Since(closed).Round(time.Second)))
+	}
+	device := old.Device()
+	if device == "" {
+		return errors.New("connection never sent a frame")
+	}
+	if c.device != "" && c.device != device {
+		return errors.New(fmt.Sprintf("token of device %s presented by %s", device, c.device))
+	}
+	//missed frames are encoded already
+	if c.protocol != old.protocol {
+		return errors.New(fmt.Sprintf("connection spoke %q, not %q", old.protocol, c.protocol))
+	}
+	if !gone {
+		old.hangUp("resumed by a new connection", "resumed elsewhere")
+	}
+	//whatever the old connection writes until it is cleaned up is missed
+	//too. A device that is not read from for PongWait is gone, so the wait
+	//stops there.
+	select {
+	case <-old.finished():
+	case <-time.After(heartbeat.PongWait):
+		log.Printf("resume: %s: old connection still open after %s", device, heartbeat.PongWait)
+	}
+
+	old.mu.Lock()
+	state, order, lang, config, audioID, sess := old.state, old.order, old.lang, old.config, old.audioID, old.sess
+	missed := old.missed
+	old.missed = nil
+	old.mu.Unlock()
+
+	c.mu.Lock()
+	c.state, c.order, c.lang, c.config, c.audioID, c.sess = state, order, lang, config, audioID, sess
+	c.mu.Unlock()
+	if c.device == "" {
+		c.setDevice(device)
+	}
+	if sess != nil {
+		sessions.Restore(sess)
+	}
+	log.Printf("resume: %s, replaying %d missed frames", device, len(missed))
+	if err := c.writeFrames(missed); err != nil {
+		return err
+	}
+	return c.pushOutput(device, "resumed", state[3], order)
+}
+
+//Expire drops closed connections older than Window
+func (s *ResumeStore) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, c := range s.conns {
+		if gone, closed := c.closed(); gone && time.Since(closed) >= s.Window {
+			delete(s.conns, token)
+		}
+	}
+}
+
+//closed reports whether c is gone and when it went
+func (c *Conn) closed() (bool, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gone, c.closedAt
+}
+
+//keepMissed holds frames for the device's next connection, at most
+//maxMissed of them. Called with c.mu held.
+func (c *Conn) keepMissed(frames ...Frame) {
+	c.missed = append(c.missed, frames...)
+	if n := len(c.missed) - maxMissed; n > 0 {
+		c.missed = c.missed[n:]
+	}
+}
@@ -7,422 +7,777 @@
 package main
 
 import (
+    "bytes"
+    "context"
 	"flag"
 	"html/template"
+    "io/ioutil"
 	"log"
     "fmt"
 	"net/http"
     "encoding/json"
-    "os/exec"
-    "errors"
-    "io/ioutil"
-    "bytes"
+    "sync"
     "time"
 
 	"github.com/gorilla/websocket"
-    sj "github.com/bitly/go-simplejson"
 )
 
 //Incoming Json struct
 type Data struct {
     Query string
+    Result string // outcome of an action, e.g. "actionTrue"
+    Stream string // "start" or "end" of a streamed utterance
+    Encoding string
+    SampleRate int32
+    Config *ConnConfig
+    Session string // "start" or "reset" begins a new Dialogflow session
+    Params *QueryParams // forwarded to Dialogflow as queryParams
+    Lang string // language for the rest of the connection, e.g. "es"
+    Info string // app and system versions, sent by the app when it starts
 }
 
-type Message struct {
-    Header [6]float64
-    Data   Data
+//ConnConfig holds per connection settings, changed with a config frame
+type ConnConfig struct {
+    OutputAudio *OutputAudioConfig `json:"outputAudio"`
+    Verbose bool `json:"verbose"` // add the full query result to every Output
 }
 
-//Dialogflow Query struct
-type Text struct {
-    Text string `json:"text"`
-    LanguageCode string `json:"languageCode"`
-}
-
-type TextInput struct {
-    TextInput Text `json:"text"`
-}
-
-type QueryInput struct {
-    QueryInput TextInput `json:"queryInput"`
+type Message struct {
+    ID string // chosen by the device and echoed in the reply, a retransmit reuses it
+    Header json.RawMessage // [6]float64, or a HeaderV2 on chipotle.v2 connections
+    Data   Data
 }
 
 //Output json struct
 type DataOutput struct {
+    Query string `json:"query,omitempty"` // recognized text of an audio turn
     Speech string `json:"speech"`
     Entity map[string]interface{} `json:"entity"`
+    Fallback bool `json:"fallback,omitempty"`
+    Audio *AudioRef `json:"audio,omitempty"` // synthesized talkback follows as a binary frame
+    Session string `json:"session,omitempty"` // "started" or "expired" when the turn began a new session
+    NLU *QueryResult `json:"nlu,omitempty"` // verbose connections only
+    Push string `json:"push,omitempty"` // the backend event of a pushed Output, see push.go
+    Resume string `json:"resume,omitempty"` // resume token, on the connection's first Output
 }
 
 type Output struct {
-    Header [7]float64 `json:"header"`
+    ID string `json:"id,omitempty"` // the id of the Message answered
+    Header interface{} `json:"header"` // [7]float64, or a HeaderV2 on chipotle.v2 connections
     Data DataOutput `json:"data"`
 }
 //var addr = flag.String("addr", "localhost:8080", "http service address")
 
+var nluKind = flag.String("nlu", "rest", "dialogflow transport, rest, grpc or cx")
+var projectID = flag.String("project", "chipotle-aeeb4", "dialogflow project id")
+var dialogflowURL = flag.String("dialogflow-url", "", "dialogflow REST base url, empty for the default")
+var cxLocation = flag.String("cx-location", "global", "dialogflow CX agent location")
+var cxAgent = flag.String("cx-agent", "", "dialogflow CX agent id")
+var cxPages = flag.String("cx-pages", "conf/cx_pages.json", "dialogflow CX page to intent mapping")
+var fakeScenario = flag.String("fake-dialogflow", "", "serve a local fake dialogflow from this scenario file and use it")
+var fakeAddr = flag.String("fake-addr", "localhost:8090", "fake dialogflow REST address")
+var sessionTTL = flag.Duration("session-ttl", 20*time.Minute, "idle time after which a device's dialogflow session expires")
+var timeZone = flag.String("time-zone", "America/Los_Angeles", "default time zone sent with every query")
+var geoLocation = flag.String("geo-location", "", "default \"latitude,longitude\" sent with every query")
+var defaultLang = flag.String("lang", "en", "language of connections that do not ask for one")
+var messagesDir = flag.String("messages", "conf/messages", "directory of per language talkback catalogs")
+var ttsURL = flag.String("tts-url", "", "text-to-speech REST base url, empty for the default")
+var ttsTimeout = flag.Duration("tts-timeout", 5*time.Second, "text-to-speech timeout, the reply is sent without audio past it")
+var profilesPath = flag.String("profiles", "conf/profiles.json", "per device user profiles pushed as session entity types, empty to disable")
+var credentialsPath = flag.String("credentials", "", "service account JSON key or application default credentials file, empty to find the application default credentials")
+var devicesPath = flag.String("devices", "conf/devices.json", "device registry, managed with devadmin.go")
+var deviceSecret = flag.String("device-secret", "", "file holding the key that signs device tokens, empty to disable signed tokens")
+var allowAnonymous = flag.Bool("allow-anonymous", false, "accept registered devices without credentials, trusting the first header[0] they send")
+var mintToken = flag.String("mint-token", "", "print a signed token for this device id and exit")
+var tokenTTL = flag.Duration("token-ttl", 30*24*time.Hour, "validity of tokens printed by -mint-token")
+var maxQueryLength = flag.Int("max-query-length", 256, "longest query in characters a device may send, Dialogflow's own limit is 256")
+var fakeGrpcAddr = flag.String("fake-grpc-addr", "localhost:8091", "fake dialogflow gRPC address")
+var pushSecret = flag.String("push-secret", "", "file holding the bearer key backend services push events to devices with, empty to disable /push/")
+var resumeWindow = flag.Duration("resume-window", 2*time.Minute, "time after a connection drops during which the device can resume it")
+var pingInterval = flag.Duration("ping-interval", 30*time.Second, "time between pings to every device")
+var pongWait = flag.Duration("pong-wait", 75*time.Second, "silence, not even a pong, after which a device is considered gone")
+var writeTimeout = flag.Duration("write-timeout", 10*time.Second, "time a device has to accept every frame")
+var idleTimeout = flag.Duration("idle-timeout", 10*time.Minute, "time without a frame from the device before hanging up, 0 to never")
+var idleReminder = flag.Duration("idle-reminder", 0, "time without a frame from the device before speaking the idle_reminder prompt, 0 to never")
+var dialogPath = flag.String("dialog", "conf/dialog.json", "dialog state machine, reread when it changes")
+var grammarPath = flag.String("grammar", "conf/grammar.json", "local fallback grammar, empty to disable")
+var nluTimeout = flag.Duration("nlu-timeout", 5*time.Second, "dialogflow timeout before falling back to the grammar")
+
 var upgrader = websocket.Upgrader{} // use default options
 
-func DetectIntentText(projectID, sessionID, text, languageCode string) (string, string, map[string]interface{}, error) {
-    if projectID == "" || sessionID == "" {
-        return "", "", nil, errors.New(fmt.Sprintf("Received empty project (%s) or session (%s)", projectID, sessionID))
+var nlu NLU
+var tts Synthesizer
+var sessions *SessionStore
+var defaultParams *QueryParams
+var messages Catalog
+var profiles map[string]Profile
+var deviceAuth *DeviceAuth
+var conns = NewConnRegistry()
+var resumes *ResumeStore
+var dialog *DialogStore
+
+//Turn is one device request being answered
+type Turn struct {
+    ID string // correlation id of the device's frame, sent back in error frames
+    MessageID string // the frame's own id, empty when it had none
+    Header [6]float64
+    Device string // empty until the frame's header is parsed
+    Req *NLURequest
+    Session string // "started" or "expired" when the turn began a new session
+    Sess *Session // remembers the replies to MessageID
+}
+
+//Conn serializes writes from the echo loop and background senders and
+//holds the connection's settings
+type Conn struct {
+    *websocket.Conn
+    mu sync.Mutex
+    config ConnConfig
+    audioID int
+    device string // authenticated device, or the first header[0] of an anonymous connection
+    lang string
+    protocol string // ProtocolV2, or empty for the legacy arrays
+    state [7]float64 // header of the last reply, pushes start from its next state
+    lastFrame time.Time // of the last frame from the device
+    closers []func() // see OnClose
+    hungUp string // why the server closed the connection, see hangUp
+    order map[string]interface{} // the partial order, the entities of the session's replies merged
+    sess *Session
+    resumeToken string
+    tokenSent bool // an Output carried resumeToken
+    gone bool // closed, writes are kept for a resuming connection
+    closedAt time.Time
+    cleaned chan struct{} // closed once cleanup has run, see finished
+    missed []Frame // frames written after the connection was gone or that failed
+    stream AudioStream // open streamed utterance, used by the echo loop only
+    streamDone chan struct{}
+    send func(Frame) error // writes the frames of an HTTP transport, see http.go
+    turnOnly bool // an HTTP request: one turn, no streams, settings or pushes
+    refused string // why an HTTP request's device was turned away
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.send != nil {
+        if c.gone {
+            return ErrNotConnected
+        }
+        return c.send(Frame{messageType, data})
     }
-    basePath := "https://dialogflow.googleapis.com/v2/"
-    sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", projectID, sessionID)
+    if c.gone {
+        c.keepMissed(Frame{messageType, data})
+        return nil
+    }
+    c.SetWriteDeadline(time.Now().Add(heartbeat.WriteTimeout))
+    err := c.Conn.WriteMessage(messageType, data)
+    if err != nil {
+        c.keepMissed(Frame{messageType, data})
+    }
+    return err
+}
 
-    client := &http.Client{}
-    var jsonData QueryInput
-    jsonData.QueryInput = TextInput{Text{Text: text, LanguageCode: languageCode}}
-    jsonValue, _ := json.Marshal(jsonData)
-    detectIntentUrl := basePath + sessionPath + ":detectIntent"
-    r, err := http.NewRequest("POST", detectIntentUrl, bytes.NewBuffer(jsonValue))
+//WriteFrame sends an Output, TranscriptOutput or ErrorOutput in the
+//connection's encoding, with the synthesized talkback an Output refers to
+func (c *Conn) WriteFrame(v interface{}, audio []byte) error {
+    frames, err := c.encodeFrame(v, audio)
+    if err != nil {
+        return err
+    }
+    return c.writeFrames(frames)
+}
 
-    token, _ := GetGcloudToken()
-    var bearer = "Bearer " + token
-    r.Header.Add("Authorization", bearer)
-    r.Header.Add("Content-Type", "application/json; charset=utf-8")
+func (c *Conn) encodeFrame(v interface{}, audio []byte) ([]Frame, error) {
+    if c.protocol == ProtocolV2Proto {
+        b, err := encodeProtoFrame(v, audio)
+        if err != nil {
+            return nil, err
+        }
+        return []Frame{{websocket.BinaryMessage, b}}, nil
+    }
+    b, _ := json.Marshal(v)
+    frames := []Frame{{websocket.TextMessage, b}}
+    if o, ok := v.(*Output); ok && o.Data.Audio != nil {
+        frames = append(frames, Frame{websocket.BinaryMessage, AudioFrame(o.Data.Audio, audio)})
+    }
+    return frames, nil
+}
 
-    resp, err := client.Do(r)
+func (c *Conn) writeFrames(frames []Frame) error {
+    for _, f := range frames {
+        if err := c.WriteMessage(f.Type, f.Data); err != nil {
+            return err
+        }
+    }
+    return nil
+}
 
+//writeReply sends a reply to t, remembering it for retransmits of t's
+//message
+func (c *Conn) writeReply(t *Turn, v interface{}, audio []byte) error {
+    frames, err := c.encodeFrame(v, audio)
     if err != nil {
-        fmt.Printf("The HTTP request failed with error %s\n", err)
-    } else {
-        data, _ := ioutil.ReadAll(resp.Body)
-        //fmt.Println(string(data))
-        js, _ := sj.NewJson(data)
-        speechText := js.Get("queryResult").Get("fulfillmentText").MustString()
-        intentName := js.Get("queryResult").Get("intent").Get("displayName").MustString()
-        entities := js.Get("queryResult").Get("parameters").MustMap()
-        return speechText, intentName, entities, nil
+        return err
+    }
+    if t.MessageID != "" && t.Sess != nil {
+        remembered := frames
+        if p, ok := v.(*Output); ok && (p.Data.Resume != "" || p.Data.Session != "") {
+            //the resume token and the session change belong to the
+            //connection, not to the reply
+            q := *p
+            q.Data.Resume, q.Data.Session = "", ""
+            if remembered, err = c.encodeFrame(&q, audio); err != nil {
+                return err
+            }
+        }
+        sessions.Remember(t.Sess, t.MessageID, remembered...)
+    }
+    return c.writeFrames(frames)
+}
+
+func (c *Conn) Config() ConnConfig {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.config
+}
+
+func (c *Conn) SetConfig(cfg ConnConfig) error {
+    if cfg.OutputAudio != nil {
+        if err := cfg.OutputAudio.Validate(); err != nil {
+            return err
+        }
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.config = cfg
+    return nil
+}
+
+//Device is the connection's device, empty until an anonymous connection's
+//first frame
+func (c *Conn) Device() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.device
+}
+
+func (c *Conn) setDevice(device string) {
+    c.mu.Lock()
+    c.device = device
+    c.mu.Unlock()
+    if c.turnOnly {
+        return
+    }
+    conns.Register(device, c)
+    c.OnClose(func() { conns.Unregister(device, c) })
+}
+
+//refuse turns the device away for breaking the protocol
+func (c *Conn) refuse(message string) {
+    if c.turnOnly {
+        c.refused = message
+        return
+    }
+    c.WriteControl(websocket.CloseMessage,
+        websocket.FormatCloseMessage(websocket.ClosePolicyViolation, message),
+        time.Now().Add(time.Second))
+}
+
+//Lang is the connection's language, safe to call from any goroutine
+func (c *Conn) Lang() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.lang
+}
+
+func (c *Conn) setLang(lang string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.lang = lang
+}
+
+//Session is the Dialogflow session of the connection's last turn
+func (c *Conn) Session() *Session {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.sess
+}
+
+//setState records the header and partial order of the last Output sent,
+//for the connection and for its device, see ConnRegistry.State
+func (c *Conn) setState(h [7]float64, order map[string]interface{}) {
+    c.mu.Lock()
+    c.state, c.order = h, order
+    device := c.device
+    c.mu.Unlock()
+    if device != "" {
+        conns.setState(device, h, order)
     }
+}
 
-    return "", "", nil, nil
+//addToOrder records h like setState, with entity, the entity of a reply,
+//merged into the device's partial order. A session that has just begun
+//starts the order afresh.
+func (c *Conn) addToOrder(h [7]float64, entity map[string]interface{}, begun bool) {
+    var order map[string]interface{}
+    if !begun {
+        _, order = conns.State(c.Device())
+    }
+    merged := make(map[string]interface{}, len(order)+len(entity))
+    for k, v := range order {
+        merged[k] = v
+    }
+    for k, v := range entity {
+        //a slot the reply leaves empty keeps what an earlier turn filled
+        if v == nil || v == "" {
+            if _, ok := merged[k]; ok {
+                continue
+            }
+        }
+        merged[k] = v
+    }
+    c.setState(h, merged)
 }
 
-func GetGcloudToken() (string, error) {
-    cmd := exec.Command("gcloud", 
-        "auth",
-        "application-default",
-        "print-access-token",)
+//issueToken returns the resume token for the connection's first Output and
+//nothing for the rest
+func (c *Conn) issueToken() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.tokenSent {
+        return ""
+    }
+    c.tokenSent = true
+    return c.resumeToken
+}
 
-    out, err := cmd.Output()
+//talkback synthesizes speech when the connection asked for output audio
+func (c *Conn) talkback(speech, lang string) (*AudioRef, []byte) {
+    cfg := c.Config()
+    if cfg.OutputAudio == nil || speech == "" {
+        return nil, nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), *ttsTimeout)
+    defer cancel()
+    audio, err := tts.Synthesize(ctx, speech, lang, cfg.OutputAudio)
     if err != nil {
-        log.Fatal(err)
-        return "", err
+        log.Println("tts:", err)
+        return nil, nil
     }
+    return &AudioRef{ID: c.nextAudioID(), Encoding: cfg.OutputAudio.Encoding}, audio
+}
 
-    token := string(out)[:len(string(out))-1] // line ending subtract
-    return token, nil
+func (c *Conn) nextAudioID() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.audioID++
+    return c.audioID
 }
 
-func HeaderProcess(headerIn [6]float64, intent string, speech string, entity map[string]interface{}) (
+func HeaderProcess(headerIn [6]float64, lang string, event string, intent string, speech string, entity map[string]interface{}) (
         [7]float64, string, map[string]interface{}, error) {
     var headerOut [7]float64
     var talkback string
-    entityback := make(map[string]interface{})
+    d := dialog.Current()
 
     headerOut[0] = headerIn[0]
     headerOut[1] = headerIn[1]
     headerOut[2] = headerIn[2]
+    headerOut[4] = float64(time.Now().UnixNano() / 1000000)
+    headerOut[5] = 3
 
-    switch intent {
-    case "chipotle.burrito":
-        switch speech {
-        case "address":
-            headerOut[3] = 2000
-            talkback = "please select address, you can say recent, favorite, or nearby"
-            entityback["ordertype"] = "burrito"
-            entityback["address"] = entity["address"]
-            entity = entityback
-        case "fillings":
-            headerOut[3] = 1100
-            entityback["ordertype"] = "burrito"
-            entityback["address"] = entity["address"]
-            entity = entityback
-            talkback = "which fillings do you want?"
-        case "rice":
-            headerOut[3] = 1110
-            talkback = "fillings added, Any rice?"
-        case "beans":
-            headerOut[3] = 1120
-            talkback = "Any beans?"
-        case "toppings":
-            headerOut[3] = 1130
-            talkback = "Any toppings?"
-        case "sides":
-            headerOut[3] = 1140
-            talkback = "Any sides?"
-        case "drinks":
-            headerOut[3] = 1150
-            talkback = "Any drinks?"
-        case "Done":
-            headerOut[3] = 1160
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.burrito - yes": 
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.bowl":
-        switch speech {
-        case "address":
-            headerOut[3] = 2000
-            talkback = "please select address, you can say recent, favorite, or nearby"
-            entityback["ordertype"] = "bowl"
-            entityback["address"] = entity["address"]
-            entity = entityback
-        case "fillings":
-            headerOut[3] = 1200
-            entityback["ordertype"] = "bowl" 
-            entity = entityback
-            talkback = "which fillings do you want?"
-        case "rice":
-            headerOut[3] = 1210
-            talkback = "Any rice?"
-        case "beans":
-            headerOut[3] = 1220
-            talkback = "Any beans?"
-        case "toppings":
-            headerOut[3] = 1230
-            talkback = "Any toppings?"
-        case "sides":
-            headerOut[3] = 1240
-            talkback = "Any sides?"
-        case "drinks":
-            headerOut[3] = 1250
-            talkback = "Any drinks?"
-        case "Done":
-            headerOut[3] = 1260
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.bowl - yes": 
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.salad":
-        switch speech {
-        case "address":
-            headerOut[3] = 2000
-            talkback = "please select address, you can say recent, favorite, or nearby"
-            entityback["ordertype"] = "bowl"
-            entityback["address"] = entity["address"]
-            entity = entityback
-        case "fillings":
-            headerOut[3] = 1300
-            entityback["ordertype"] = "salad" 
-            entity = entityback
-            talkback = "which fillings do you want?"
-        case "rice":
-            headerOut[3] = 1310
-            talkback = "Any rice?"
-        case "beans":
-            headerOut[3] = 1320
-            talkback = "Any beans?"
-        case "toppings":
-            headerOut[3] = 1330
-            talkback = "Any toppings?"
-        case "sides":
-            headerOut[3] = 1340
-            talkback = "Any sides?"
-        case "drinks":
-            headerOut[3] = 1350
-            talkback = "Any drinks?"
-        case "Done":
-            headerOut[3] = 1360
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.salad - yes": 
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.tacos":
-        switch speech {
-        case "address":
-            headerOut[3] = 2000
-            talkback = "please select address, you can say recent, favorite, or nearby"
-        case "number":
-            headerOut[3] = 1400
-            entityback["ordertype"] = "tacos"
-            entity = entityback
-            talkback = "how many tacos do you want?"
-        case "tortilla":
-            headerOut[3] = 1410
-            talkback = "soft or crispy tortilla"
-        case "fillings":
-            headerOut[3] = 1400
-            talkback = "which fillings do you want?"
-        case "rice":
-            headerOut[3] = 1410
-            talkback = "Any rice?"
-        case "beans":
-            headerOut[3] = 1420
-            talkback = "Any beans?"
-        case "toppings":
-            headerOut[3] = 1430
-            talkback = "Any toppings?"
-        case "sides":
-            headerOut[3] = 1440
-            talkback = "Any sides?"
-        case "drinks":
-            headerOut[3] = 1450
-            talkback = "Any drinks?"
-        case "Done":
-            headerOut[3] = 1460
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.tacos - yes": 
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.kids": 
-        switch speech {
-        case "address":
-            headerOut[3] = 2000
-            talkback = "please select address, you can say recent, favorite, or nearby"
-        case "choose":
-            headerOut[3] = 2100
-            talkback = "build your own or quesadilla?"
-        default:
-            talkback = speech
-        }
-    case "chipotle.kids - buildyourown": 
-        switch speech {
-        case "tortilla":
-            headerOut[3] = 1500
-            talkback = "soft or crispy tortilla?"
-        case "fillings":
-            headerOut[3] = 1510
-            talkback = "which fillings do you want?"
-        case "beans":
-            headerOut[3] = 1520
-            talkback = "Any beans?"
-        default:
-            talkback = speech
-        }
-    case "chipotle.kids - quesadilla": 
-        switch speech {
-        case "fillings":
-            headerOut[3] = 1600
-            talkback = "which fillings do you want?"
-        case "rice":
-            headerOut[3] = 1610
-            talkback = "Any rice?"
-        case "beans":
-            headerOut[3] = 1620
-            talkback = "Any beans?"
-        case "kidsides":
-            headerOut[3] = 1630 
-            talkback = "Any sides for kids?"
-        case "kidsdrinks":
-            headerOut[3] = 1640 
-            talkback = "Any drinks for kids?"
-        case "Done":
-            headerOut[3] = 1720
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.sides&drinks":
-        switch speech {
-        case "address":
-            headerOut[3] = 100
-            talkback = "please select address, you can say recent, favorite, or nearby"
-        case "sides":
-            headerOut[3] = 1700
-            talkback = "Any sides?"
-        case "drinks":
-            headerOut[3] = 1710
-            talkback = "Any drinks?"
-        case "Done":
-            headerOut[3] = 1720
-            talkback = "Okay, Do you want to add item to cart"
-        default:
-            talkback = speech
-        }
-    case "chipotle.sides&drinks - yes": 
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.addtobag":
-        headerOut[3] = 1900
-        talkback = speech
-    case "chipotle.cart":
-        headerOut[3] = 5000
-        talkback = speech
-    case "chipotle.recents":
-        headerOut[3] = 3000
-        talkback = speech 
-    case "chipotle.recents - select.number":
-        headerOut[3] = 5000
-        talkback = speech
-    case "chipotle.confirm":
-        switch speech {
-        case "time":
-            headerOut[3] = 6000
-            talkback = "please tell me the pickup time"
-        case "payment":
-            headerOut[3] = 6100
-            str := fmt.Sprintf("%v", entity["time"])
-            str1, _ := time.Parse(time.RFC3339, str)
-            entityback["time"] = str1.Format("3:04 PM")
-            entityback["payment"] = entity["payment"]
-            entity = entityback
-            talkback = "please tell me payment type, you can say google pay or credit card"
-        case "Done":
-            headerOut[3] = 6200
-            talkback = "Okay, Do you want to submit order?"
-        default:
-            talkback = speech
-        }
-    case "chipotle.confirm - yes":
-        headerOut[3] = 7000
-        talkback = speech
-    default:
+    if event != "" {
+        headerOut[3] = StateAwaitPrompt
         talkback = speech
+        if key, ok := d.Prompt(headerIn[2]); ok && event == "ACTION_TRUE" {
+            talkback = messages.Text(lang, key)
+        }
+        return headerOut, talkback, entity, nil
     }
 
-    headerOut[4] = float64(time.Now().UnixNano() / 1000000)
-    headerOut[5] = 3
-    return headerOut, talkback, entity, nil
+    step := d.Step(intent, speech)
+    headerOut[3] = step.Next
+    talkback = speech
+    if step.Prompt != "" {
+        talkback = messages.Text(lang, step.Prompt)
+    }
+    return headerOut, talkback, step.entity(entity), nil
+}
+
+func respond(c *Conn, t *Turn, res *QueryResult) error {
+    req := t.Req
+    var p Output
+    var event string
+    if req.Event != nil {
+        event = req.Event.Name
+    }
+    var h [7]float64
+    var err error
+    h, p.Data.Speech, p.Data.Entity, err = HeaderProcess(t.Header, req.LanguageCode, event, res.Intent, res.FulfillmentText, res.Parameters)
+    if err != nil {
+        return respondError(c, t, &FrameError{Code: ErrInternal, Message: err.Error()})
+    }
+    p.ID = t.MessageID
+    if res.Fallback && res.Intent == "" && req.Event == nil {
+        //the grammar's default, the device stays where it is as it would
+        //on an error frame and the user says it again. An action result
+        //still ends in 9999.
+        h[3] = h[2]
+    } else {
+        c.addToOrder(h, p.Data.Entity, t.Session != "")
+    }
+    p.Header = formatHeader(c.protocol, t.Device, h)
+    p.Data.Resume = c.issueToken()
+    p.Data.Fallback = res.Fallback
+    p.Data.Session = t.Session
+    if req.Audio != nil || req.AudioEncoding != "" {
+        p.Data.Query = res.QueryText
+    }
+
+    if c.Config().Verbose {
+        p.Data.NLU = res
+    }
+
+    var audio []byte
+    p.Data.Audio, audio = c.talkback(p.Data.Speech, req.LanguageCode)
+
+    return c.writeReply(t, &p, audio)
+}
+
+//respondError answers t with an error frame instead of a reply. The header,
+//when the frame's could be parsed, keeps the device in its current state.
+func respondError(c *Conn, t *Turn, e *FrameError) error {
+    e.ID = t.ID
+    log.Println("error:", e)
+    out := ErrorOutput{ID: t.MessageID, Error: e}
+    if t.Device != "" {
+        h := [7]float64{t.Header[0], t.Header[1], t.Header[2], t.Header[2]}
+        h[4] = float64(time.Now().UnixNano() / 1000000)
+        h[5] = 3
+        out.Header = formatHeader(c.protocol, t.Device, h)
+    }
+    return c.WriteFrame(&out, nil)
+}
+
+//respondInfo acknowledges an info frame, leaving the device in its current
+//state to wait for the user's first utterance
+func respondInfo(c *Conn, t *Turn) error {
+    var p Output
+    h := [7]float64{t.Header[0], t.Header[1], t.Header[2], StateAwaitPrompt}
+    h[4] = float64(time.Now().UnixNano() / 1000000)
+    h[5] = 3
+    p.ID = t.MessageID
+    p.Header = formatHeader(c.protocol, t.Device, h)
+    _, order := conns.State(t.Device)
+    c.setState(h, order)
+    p.Data.Resume = c.issueToken()
+    return c.writeReply(t, &p, nil)
+}
+
+//setSessionEntities teaches a freshly started session the device user's own
+//stores and past orders. It runs beside the turn, which does not wait for
+//Dialogflow to learn them.
+func setSessionEntities(device string, sess *Session) {
+    p, ok := profiles[device]
+    if !ok {
+        return
+    }
+    s, ok := nlu.(SessionEntityTyper)
+    if !ok {
+        log.Println("entities: nlu provider does not support session entity types")
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), *nluTimeout)
+    defer cancel()
+    if err := s.SetSessionEntities(ctx, sess.ID, p.EntityTypes()); err != nil {
+        log.Println("entities:", err)
+    }
 }
 
 func echo(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+    device, protocol, err := deviceAuth.Authenticate(r)
+    if err != nil {
+        log.Printf("auth: %s: %s", r.RemoteAddr, err)
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    //only one subprotocol can be accepted, the version wins over the
+    //credential
+    v := negotiateProtocol(r)
+    if v != "" {
+        protocol = v
+    }
+    token := newResumeToken()
+    responseHeader := http.Header{resumeHeader: {token}}
+    if protocol != "" {
+        responseHeader.Set("Sec-Websocket-Protocol", protocol)
+    }
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
-	defer c.Close()
+	c := &Conn{Conn: ws, protocol: v, lang: messages.NegotiateLang(r.Header.Get("Accept-Language"), *defaultLang), resumeToken: token}
+    if device != nil {
+        if device.Lang != "" {
+            c.lang = device.Lang
+        }
+        c.setDevice(device.ID)
+    }
+	defer c.cleanup()
+
+    c.OnClose(c.endStream)
+    done := make(chan struct{})
+    c.OnClose(func() { close(done) })
+    c.touch()
+    c.SetPongHandler(func(string) error {
+        c.SetReadDeadline(time.Now().Add(heartbeat.PongWait))
+        return nil
+    })
+    go c.keepAlive(done)
+    resumes.Add(c)
+    if old := resumeToken(r); old != "" {
+        if err := resumes.Resume(c, old); err != nil {
+            log.Printf("resume: %s: %s", c.name(), err)
+        }
+    }
 	for {
 		mt, message, err := c.ReadMessage()
 		if err != nil {
-			log.Println("read:", err)
+            if reason := c.hangUpReason(); reason != "" {
+                log.Printf("close: %s: hung up, %s", c.name(), reason)
+            } else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+                log.Printf("close: %s: %s", c.name(), err)
+            } else {
+                log.Printf("read: %s: peer gone: %s", c.name(), err)
+            }
 			break
 		}
-		log.Printf("\nrecv: %s", message)
-
-        var m Message
-        json.Unmarshal(message, &m)
-        // if err1 != nil {
-        //     log.Fatalln("error:", err1)
-        //     break
-        // }
-        s, i, e, _ := DetectIntentText("chipotle-aeeb4", "123", m.Data.Query, "en")
-
-        var p Output
-        p.Header, p.Data.Speech, p.Data.Entity, _ = HeaderProcess(m.Header, i, s, e)
-        b, _ := json.Marshal(p)
-        fmt.Printf(string(b))
-		err = c.WriteMessage(mt, b)
+        c.touch()
 
-		if err != nil {
-			log.Println("write:", err)
-			break
-		}
+        if !handleFrame(r.Context(), c, mt, message) {
+            break
+        }
 	}
 }
 
+//handleFrame processes one frame from the device on c, whatever its
+//transport. It returns false when the connection must be closed.
+func handleFrame(ctx context.Context, c *Conn, mt int, message []byte) bool {
+    var err error
+    t := &Turn{ID: newNonce()}
+    var m Message
+    req := &NLURequest{}
+    var ferr *FrameError
+    //while a stream is open binary frames are its chunks, on
+    //chipotle.v2.proto frames that carry nothing but audio
+    chunk := message
+    if c.protocol == ProtocolV2Proto {
+        if mt != websocket.BinaryMessage {
+            ferr = &FrameError{Code: ErrMalformed, Message: "chipotle.v2.proto frames are binary"}
+        } else {
+            req.Audio, ferr = decodeProtoFrame(message, &m)
+        }
+        chunk = req.Audio
+        if len(m.Header) > 0 || m.Data.Stream != "" {
+            chunk = nil
+        }
+    } else if mt != websocket.BinaryMessage {
+        chunk = nil
+    }
+    if ferr == nil && chunk != nil && c.streamOpen() {
+        if err := c.stream.Send(chunk); err != nil {
+            c.endStream()
+            if err := respondError(c, t, &FrameError{Code: ErrNLU, Message: err.Error()}); err != nil {
+                log.Println("write:", err)
+                return false
+            }
+        }
+        return true
+    }
+
+    if c.protocol == ProtocolV2Proto {
+        b, _ := json.Marshal(m)
+        log.Printf("\nrecv: proto %s, %d bytes of audio", b, len(req.Audio))
+        req.Text = m.Data.Query
+        if req.Audio != nil {
+            req.AudioEncoding, req.SampleRate = m.Data.Encoding, m.Data.SampleRate
+        }
+    } else if mt == websocket.BinaryMessage {
+        pre, audio, err := ParseAudioFrame(message)
+        if err != nil {
+            ferr = &FrameError{Code: ErrMalformed, Message: err.Error()}
+        } else {
+            log.Printf("\nrecv: audio %s %dHz %d bytes", pre.Encoding, pre.SampleRate, len(audio))
+            m.ID, m.Header = pre.ID, pre.Header
+            m.Data.Encoding, m.Data.SampleRate = pre.Encoding, pre.SampleRate
+            req.Audio, req.AudioEncoding, req.SampleRate = audio, pre.Encoding, pre.SampleRate
+        }
+    } else {
+        log.Printf("\nrecv: %s", message)
+        if err := decodeStrict(message, &m); err != nil {
+            ferr = decodeError(err)
+        }
+        req.Text = m.Data.Query
+    }
+    if m.ID != "" && len(m.ID) <= maxMessageID {
+        t.ID, t.MessageID = m.ID, m.ID
+    }
+    var header [6]float64
+    var device string
+    if ferr == nil && len(m.Header) > 0 {
+        header, device, ferr = parseHeader(c.protocol, m.Header)
+        if ferr == nil {
+            t.Header, t.Device = header, device
+            ferr = validateFrame(&m, &header, req.Audio != nil, *maxQueryLength)
+        }
+    } else if ferr == nil {
+        ferr = validateFrame(&m, nil, req.Audio != nil, *maxQueryLength)
+    }
+    if ferr == nil && c.turnOnly && (m.Data.Config != nil || m.Data.Stream != "") {
+        ferr = &FrameError{Code: ErrUnsupported, Message: "config and stream frames need a WebSocket"}
+    }
+    if ferr == nil && m.Data.Config != nil {
+        if err := c.SetConfig(*m.Data.Config); err != nil {
+            ferr = &FrameError{Code: ErrInvalidField, Field: "data.config.outputAudio", Message: err.Error()}
+        }
+    }
+    if ferr != nil {
+        if err := respondError(c, t, ferr); err != nil {
+            log.Println("write:", err)
+            return false
+        }
+        return true
+    }
+
+    if m.Data.Result != "" {
+        req.Event = ActionEvent(m.Data.Result, header[2])
+    }
+    req.State = header[2]
+    if m.Data.Lang != "" {
+        c.setLang(m.Data.Lang)
+    }
+    req.LanguageCode = c.lang
+
+    if m.Data.Config != nil {
+        return true
+    }
+    if m.Data.Stream == "end" {
+        c.endStream()
+        return true
+    }
+
+    if c.device == "" {
+        d, err := deviceAuth.Registry.Lookup(device)
+        if err != nil {
+            log.Println("auth:", err)
+            c.refuse("device is not registered")
+            return false
+        }
+        c.setDevice(d.ID)
+        if d.Lang != "" && m.Data.Lang == "" {
+            c.setLang(d.Lang)
+            req.LanguageCode = c.lang
+        }
+    }
+    if device != c.device {
+        log.Printf("auth: device %s sent device id %s", c.device, device)
+        c.refuse("device id does not match the device credential")
+        return false
+    }
+
+    if m.Data.Info != "" && m.Data.Query == "" && m.Data.Result == "" {
+        log.Printf("info: %s: %s", device, m.Data.Info)
+        if err := respondInfo(c, t); err != nil {
+            log.Println("write:", err)
+            return false
+        }
+        return true
+    }
+
+    if m.ID != "" {
+        sess := c.Session()
+        if sess == nil {
+            //a new connection, or an HTTP request, continues the device's
+            //session
+            sess = sessions.Current(device)
+        }
+        if frames, ok := sessions.Replay(sess, m.ID); ok {
+            log.Printf("replaying the reply to retransmitted message %s", m.ID)
+            if err := c.writeFrames(frames); err != nil {
+                log.Println("write:", err)
+                return false
+            }
+            return true
+        }
+    }
+
+    t.Req = req
+    var sess *Session
+    if m.Data.Session == "start" || m.Data.Session == "reset" {
+        sess = sessions.Begin(device)
+        t.Session = "started"
+    } else {
+        var started, expired bool
+        sess, started, expired = sessions.Continue(device)
+        if expired {
+            t.Session = "expired"
+        } else if started {
+            t.Session = "started"
+        }
+    }
+    req.SessionID = sess.ID
+    t.Sess = sess
+    c.mu.Lock()
+    c.sess = sess
+    c.mu.Unlock()
+    if t.Session != "" {
+        go setSessionEntities(device, sess)
+    }
+    req.Params = m.Data.Params.WithDefaults(defaultParams)
+
+    switch m.Data.Stream {
+    case "start":
+        c.endStream()
+        s, ok := nlu.(StreamingNLU)
+        if !ok {
+            err = respondError(c, t, &FrameError{Code: ErrUnsupported, Field: "data.stream",
+                Message: "nlu provider does not support streaming"})
+            if err != nil {
+                log.Println("write:", err)
+                return false
+            }
+            return true
+        }
+        req.AudioEncoding, req.SampleRate = m.Data.Encoding, m.Data.SampleRate
+        c.stream, err = s.StreamDetectIntent(ctx, req)
+        if err != nil {
+            c.stream = nil
+            if err := respondError(c, t, &FrameError{Code: ErrNLU, Message: err.Error()}); err != nil {
+                log.Println("write:", err)
+                return false
+            }
+            return true
+        }
+        c.streamDone = make(chan struct{})
+        go relayStream(c, t, c.stream, c.streamDone)
+        return true
+    }
+
+    res, err := nlu.DetectIntent(ctx, req)
+    if err != nil {
+        err = respondError(c, t, &FrameError{Code: ErrNLU, Message: err.Error()})
+    } else {
+        err = respond(c, t, res)
+    }
+    if err != nil {
+        log.Println("write:", err)
+        return false
+    }
+    return true
+}
+
 func home(w http.ResponseWriter, r *http.Request) {
 	homeTemplate.Execute(w, "ws://"+r.Host+"/echo/")
 }
@@ -430,7 +785,123 @@ func home(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
+    deviceAuth = &DeviceAuth{AllowAnonymous: *allowAnonymous}
+    if *deviceSecret != "" {
+        secret, err := ioutil.ReadFile(*deviceSecret)
+        if err != nil {
+            log.Fatal("device secret:", err)
+        }
+        deviceAuth.Secret = bytes.TrimSpace(secret)
+    }
+    if *mintToken != "" {
+        if deviceAuth.Secret == nil {
+            log.Fatal("mint-token: needs -device-secret")
+        }
+        fmt.Println(SignDeviceToken(deviceAuth.Secret, *mintToken, time.Now().Add(*tokenTTL)))
+        return
+    }
+    registry, err := OpenRegistry(*devicesPath)
+    if err != nil {
+        log.Fatal("devices:", err)
+    }
+    deviceAuth.Registry = registry
+    cfg := NLUConfig{Kind: *nluKind, ProjectID: *projectID, BaseURL: *dialogflowURL,
+        Location: *cxLocation, AgentID: *cxAgent}
+    if *nluKind == "cx" {
+        pages, err := LoadCxPages(*cxPages)
+        if err != nil {
+            log.Fatal("cx pages:", err)
+        }
+        cfg.Pages = pages
+    }
+    if *fakeScenario != "" {
+        if _, err := StartFakeDialogflow(*fakeScenario, *fakeAddr, *fakeGrpcAddr); err != nil {
+            log.Fatal("fake dialogflow:", err)
+        }
+        cfg.BaseURL = "http://" + *fakeAddr + "/v2/"
+        if *nluKind == "cx" {
+            cfg.BaseURL = "http://" + *fakeAddr + "/v3/"
+        }
+        cfg.Endpoint = *fakeGrpcAddr
+        cfg.Insecure = true
+    }
+    synth := NewCloudTTS(*ttsURL)
+    if *fakeScenario != "" {
+        synth.BasePath = "http://" + *fakeAddr + "/v1/"
+    } else {
+        creds := NewCredentials(context.Background(), *credentialsPath)
+        go creds.Run(context.Background())
+        cfg.Credentials = creds
+        synth.Token = creds.AccessToken
+    }
+    tts = synth
+
+    defaultParams = &QueryParams{TimeZone: *timeZone}
+    if *geoLocation != "" {
+        var g GeoLocation
+        if _, err := fmt.Sscanf(*geoLocation, "%f,%f", &g.Latitude, &g.Longitude); err != nil {
+            log.Fatal("geo-location:", err)
+        }
+        defaultParams.GeoLocation = &g
+    }
+
+    messages, err = LoadCatalog(*messagesDir)
+    if err != nil {
+        log.Fatal("messages:", err)
+    }
+    dialog, err = OpenDialog(*dialogPath, messages)
+    if err != nil {
+        log.Fatal("dialog:", err)
+    }
+
+    if *profilesPath != "" {
+        profiles, err = LoadProfiles(*profilesPath)
+        if err != nil {
+            log.Fatal("profiles:", err)
+        }
+    }
+
+    heartbeat = Heartbeat{
+        PingInterval: *pingInterval,
+        PongWait: *pongWait,
+        WriteTimeout: *writeTimeout,
+        IdleTimeout: *idleTimeout,
+        IdleReminder: *idleReminder,
+    }
+    if heartbeat.PingInterval >= heartbeat.PongWait {
+        log.Fatal("ping-interval must be shorter than pong-wait")
+    }
+
+    sessions = NewSessionStore(*sessionTTL)
+    resumes = NewResumeStore(*resumeWindow)
+    go func() {
+        for range time.Tick(time.Minute) {
+            sessions.Expire()
+            resumes.Expire()
+        }
+    }()
+
+    nlu, err = NewNLU(cfg)
+    if err != nil {
+        log.Fatal("nlu:", err)
+    }
+    if *grammarPath != "" {
+        g, err := LoadGrammar(*grammarPath)
+        if err != nil {
+            log.Fatal("grammar:", err)
+        }
+        nlu = NewFallbackNLU(nlu, g, *nluTimeout)
+    }
+    if *pushSecret != "" {
+        secret, err := ioutil.ReadFile(*pushSecret)
+        if err != nil {
+            log.Fatal("push secret:", err)
+        }
+        http.HandleFunc("/push/", pushHandler(conns, bytes.TrimSpace(secret)))
+    }
 	http.HandleFunc("/chipotle", echo)
+    http.HandleFunc("/turn", turnHandler)
+    http.HandleFunc("/events", eventsHandler)
 	http.HandleFunc("/", home)
 	//log.Fatal(http.ListenAndServe(*addr, nil))
     log.Fatal(http.ListenAndServe(":8080", nil))
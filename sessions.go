@@ -0,0 +1,162 @@
+// +build ignore
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Session is one device's Dialogflow conversation. The Dialogflow session id
+//is the device id plus a nonce, so devices never share contexts and a reset
+//gives the device a clean conversation.
+type Session struct {
+	ID       string
+	Device   string
+	Started  time.Time
+	LastUsed time.Time
+
+	replies map[string][]Frame // by message id, see Remember
+	order   []string           // message ids in replies, oldest first
+}
+
+//Frame is one WebSocket message as it was written to the device
+type Frame struct {
+	Type int
+	Data []byte
+}
+
+//maxReplies is how many answered message ids a session remembers
+const maxReplies = 32
+
+//SessionStore keeps the current session of every device. A session that has
+//not been used for TTL is expired, as Dialogflow drops its contexts by then.
+type SessionStore struct {
+	TTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{TTL: ttl, sessions: make(map[string]*Session)}
+}
+
+//deviceID formats the device id carried in header[0]
+func deviceID(h float64) string {
+	return strconv.FormatFloat(h, 'f', -1, 64)
+}
+
+func newNonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//Begin starts a new session for device, replacing any previous one
+func (s *SessionStore) Begin(device string) *Session {
+	now := time.Now()
+	sess := &Session{ID: device + "-" + newNonce(), Device: device, Started: now, LastUsed: now}
+	s.mu.Lock()
+	s.sessions[device] = sess
+	s.mu.Unlock()
+	return sess
+}
+
+//Continue returns the device's session, starting a new one when it has none
+//or the old one expired
+func (s *SessionStore) Continue(device string) (sess *Session, started, expired bool) {
+	now := time.Now()
+	s.mu.Lock()
+	sess, ok := s.sessions[device]
+	if ok && now.Sub(sess.LastUsed) < s.TTL {
+		sess.LastUsed = now
+		s.mu.Unlock()
+		return sess, false, false
+	}
+	s.mu.Unlock()
+	return s.Begin(device), true, ok
+}
+
+//Restore makes sess its device's current session again, unless it has
+//expired
+func (s *SessionStore) Restore(sess *Session) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(sess.LastUsed) >= s.TTL {
+		return false
+	}
+	sess.LastUsed = now
+	s.sessions[sess.Device] = sess
+	return true
+}
+
+//End forgets the device's session
+func (s *SessionStore) End(device string) {
+	s.mu.Lock()
+	delete(s.sessions, device)
+	s.mu.Unlock()
+}
+
+//Expire drops every session that has not been used for TTL
+func (s *SessionStore) Expire() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for device, sess := range s.sessions {
+		if now.Sub(sess.LastUsed) >= s.TTL {
+			delete(s.sessions, device)
+		}
+	}
+}
+
+//Remember appends frames to those answering message id in sess, so a
+//retransmit of the message can be answered without asking Dialogflow again.
+//Only the latest maxReplies ids are kept.
+func (s *SessionStore) Remember(sess *Session, id string, frames ...Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.replies == nil {
+		sess.replies = make(map[string][]Frame)
+	}
+	if _, ok := sess.replies[id]; !ok {
+		sess.order = append(sess.order, id)
+		if len(sess.order) > maxReplies {
+			delete(sess.replies, sess.order[0])
+			sess.order = sess.order[1:]
+		}
+	}
+	sess.replies[id] = append(sess.replies[id], frames...)
+}
+
+//Current returns the device's session, nil when it has none or it expired
+func (s *SessionStore) Current(device string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[device]
+	if !ok || time.Since(sess.LastUsed) >= s.TTL {
+		return nil
+	}
+	return sess
+}
+
+//Replay returns the frames that answered message id in sess, as long as it
+//is still its device's current session. A connection replays from its own
+//session only, so once another connection begins a new one an id reused on
+//it is answered afresh.
+func (s *SessionStore) Replay(sess *Session, id string) ([]Frame, bool) {
+	if sess == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.Device] != sess || time.Since(sess.LastUsed) >= s.TTL {
+		return nil, false
+	}
+	frames, ok := sess.replies[id]
+	return frames, ok
+}
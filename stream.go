@@ -0,0 +1,83 @@
+// +build ignore
+
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+//TranscriptOutput is pushed while a streamed utterance is being recognized
+type TranscriptOutput struct {
+	ID     string      `json:"id,omitempty"` // the id of the stream's start Message
+	Header interface{} `json:"header"`
+	Data   struct {
+		Transcript string `json:"transcript"`
+		Final      bool   `json:"final"`
+	} `json:"data"`
+}
+
+//relayStream forwards interim transcripts from stream to the device and
+//answers the detected intent with a regular Output, then closes done
+func relayStream(c *Conn, t *Turn, stream AudioStream, done chan<- struct{}) {
+	defer close(done)
+	for {
+		sr, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if err := respondError(c, t, &FrameError{Code: ErrNLU, Message: err.Error()}); err != nil {
+				log.Println("write:", err)
+			}
+			return
+		}
+		if sr.Result != nil {
+			if err := respond(c, t, sr.Result); err != nil {
+				log.Println("write:", err)
+			}
+			continue
+		}
+
+		var o TranscriptOutput
+		var h [7]float64
+		h[0], h[1], h[2] = t.Header[0], t.Header[1], t.Header[2]
+		h[4] = float64(time.Now().UnixNano() / 1000000)
+		h[5] = 3
+		o.ID = t.MessageID
+		o.Header = formatHeader(c.protocol, t.Device, h)
+		o.Data.Transcript = sr.Transcript
+		o.Data.Final = sr.Final
+		if err := c.writeReply(t, &o, nil); err != nil {
+			log.Println("write:", err)
+			return
+		}
+	}
+}
+
+//endStream ends the open stream, if any, and waits for its relay to answer
+//it, so the next stream's relay never writes alongside it
+func (c *Conn) endStream() {
+	if c.stream == nil {
+		return
+	}
+	c.stream.CloseSend()
+	<-c.streamDone
+	c.stream = nil
+}
+
+//streamOpen reports whether a stream is open. A stream Dialogflow ended by
+//itself is cleared, so the next audio frame starts a new one.
+func (c *Conn) streamOpen() bool {
+	if c.stream == nil {
+		return false
+	}
+	select {
+	case <-c.streamDone:
+		c.stream = nil
+		return false
+	default:
+		return true
+	}
+}
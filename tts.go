@@ -0,0 +1,105 @@
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+//OutputAudioConfig asks for the talkback to be synthesized. It is set per
+//connection with a config frame.
+type OutputAudioConfig struct {
+	Encoding     string  `json:"encoding"` // "MP3", "OGG_OPUS" or "LINEAR16"
+	Voice        string  `json:"voice"`    // e.g. "en-US-Wavenet-D", empty for the default voice
+	SpeakingRate float64 `json:"speakingRate"`
+}
+
+var outputAudioEncodings = map[string]bool{"MP3": true, "OGG_OPUS": true, "LINEAR16": true}
+
+func (o *OutputAudioConfig) Validate() error {
+	if !outputAudioEncodings[o.Encoding] {
+		return errors.New(fmt.Sprintf("Unsupported output audio encoding %q", o.Encoding))
+	}
+	if o.SpeakingRate != 0 && (o.SpeakingRate < 0.25 || o.SpeakingRate > 4) {
+		return errors.New(fmt.Sprintf("Speaking rate %v out of range", o.SpeakingRate))
+	}
+	return nil
+}
+
+//Synthesizer turns talkback text into audio
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text, languageCode string, cfg *OutputAudioConfig) ([]byte, error)
+}
+
+//CloudTTS synthesizes speech with the Cloud Text-to-Speech REST API
+type CloudTTS struct {
+	BasePath string
+	Client   *http.Client
+	Token    func() (string, error) // nil sends no Authorization header
+}
+
+func NewCloudTTS(basePath string) *CloudTTS {
+	if basePath == "" {
+		basePath = "https://texttospeech.googleapis.com/v1/"
+	}
+	return &CloudTTS{BasePath: basePath, Client: &http.Client{}}
+}
+
+func (t *CloudTTS) Synthesize(ctx context.Context, text, languageCode string, cfg *OutputAudioConfig) ([]byte, error) {
+	voice := map[string]interface{}{"languageCode": languageCode}
+	if cfg.Voice != "" {
+		voice["name"] = cfg.Voice
+	}
+	audioConfig := map[string]interface{}{"audioEncoding": cfg.Encoding}
+	if cfg.SpeakingRate != 0 {
+		audioConfig["speakingRate"] = cfg.SpeakingRate
+	}
+	body := map[string]interface{}{
+		"input":       map[string]interface{}{"text": text},
+		"voice":       voice,
+		"audioConfig": audioConfig,
+	}
+	jsonValue, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", t.BasePath+"text:synthesize", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+	if t.Token != nil {
+		token, err := t.Token()
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Add("Authorization", "Bearer "+token)
+	}
+	r.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := t.Client.Do(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("The HTTP request failed with error %s", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("text:synthesize returned %s: %s", resp.Status, data))
+	}
+	var out struct {
+		AudioContent []byte `json:"audioContent"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out.AudioContent, nil
+}
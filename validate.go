@@ -0,0 +1,150 @@
+// +build ignore
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+//FrameError codes
+const (
+	ErrMalformed    = "malformed_frame" // not JSON, or not the frame schema
+	ErrInvalidField = "invalid_field"
+	ErrUnknownState = "unknown_state"
+	ErrQueryTooLong = "query_too_long"
+	ErrUnsupported  = "unsupported" // valid, but not possible with this server
+	ErrNLU          = "nlu_error"
+	ErrInternal     = "internal_error"
+)
+
+//FrameError is sent to the device instead of a reply when its frame cannot
+//be answered. ID is logged with the failure so the two can be matched.
+type FrameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"` // e.g. "data.query"
+	ID      string `json:"id"`
+}
+
+func (e *FrameError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s %s: %s: %s", e.ID, e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.ID, e.Code, e.Message)
+}
+
+//ErrorOutput is the error frame
+type ErrorOutput struct {
+	ID     string      `json:"id,omitempty"` // the id of the Message that failed
+	Header interface{} `json:"header,omitempty"`
+	Error  *FrameError `json:"error"`
+}
+
+//knownState reports whether a device can be in state s, see conf/dialog.json
+func knownState(s float64) bool {
+	return dialog.Current().Known(s)
+}
+
+//maxMessageID is the longest message id a device may choose
+const maxMessageID = 64
+
+var actionResult = regexp.MustCompile(`^[A-Za-z]+(:.*)?$`)
+
+//decodeStrict unmarshals data into v, rejecting unknown fields and
+//trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data after the frame")
+	}
+	return nil
+}
+
+//decodeError turns a decoding error into a FrameError naming the field
+func decodeError(err error) *FrameError {
+	e := &FrameError{Code: ErrMalformed, Message: err.Error()}
+	if te, ok := err.(*json.UnmarshalTypeError); ok && te.Field != "" {
+		e.Code, e.Field = ErrInvalidField, jsonField(te.Field)
+	}
+	return e
+}
+
+//jsonField lowercases the first letter of every segment of a Go field path,
+//"Data.SampleRate" is "data.sampleRate"
+func jsonField(path string) string {
+	parts := strings.Split(path, ".")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToLower(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+//validateFrame checks a decoded frame; header is nil when the frame had
+//none. Audio frames carry no query, info frames nothing but the info.
+func validateFrame(m *Message, header *[6]float64, audio bool, maxQuery int) *FrameError {
+	d := &m.Data
+	invalid := func(field, format string, a ...interface{}) *FrameError {
+		return &FrameError{Code: ErrInvalidField, Field: field, Message: fmt.Sprintf(format, a...)}
+	}
+	if n := len(m.ID); n > maxMessageID {
+		return invalid("id", "%d bytes, at most %d", n, maxMessageID)
+	}
+	if d.Config != nil || d.Stream == "end" {
+		return nil
+	}
+	if header == nil {
+		return invalid("header", "missing")
+	}
+	if !knownState(header[2]) {
+		return &FrameError{Code: ErrUnknownState, Field: "header.currentState",
+			Message: fmt.Sprintf("unknown state %v", header[2])}
+	}
+	if d.Lang != "" && !messages.Supports(d.Lang) {
+		return invalid("data.lang", "unsupported language %q", d.Lang)
+	}
+	switch d.Session {
+	case "", "start", "reset":
+	default:
+		return invalid("data.session", "must be \"start\" or \"reset\", not %q", d.Session)
+	}
+	switch d.Stream {
+	case "", "start":
+	default:
+		return invalid("data.stream", "must be \"start\" or \"end\", not %q", d.Stream)
+	}
+	if d.Stream == "start" || audio {
+		if _, err := audioEncoding(d.Encoding); err != nil {
+			return invalid("data.encoding", "%s", err)
+		}
+		if d.Encoding == "LINEAR16" && d.SampleRate <= 0 {
+			return invalid("data.sampleRate", "required for LINEAR16")
+		}
+		return nil
+	}
+	if d.Query != "" && d.Result != "" {
+		return invalid("data.result", "a frame carries either a query or a result")
+	}
+	if d.Result != "" && !actionResult.MatchString(d.Result) {
+		return invalid("data.result", "%q is not an action result", d.Result)
+	}
+	if d.Query == "" && d.Result == "" && d.Info == "" {
+		return invalid("data.query", "missing")
+	}
+	if n := utf8.RuneCountInString(d.Query); n > maxQuery {
+		return &FrameError{Code: ErrQueryTooLong, Field: "data.query",
+			Message: fmt.Sprintf("%d characters, at most %d", n, maxQuery)}
+	}
+	return nil
+}